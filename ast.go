@@ -17,6 +17,11 @@ package unique_effect
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
 )
 
 type register int
@@ -45,7 +50,7 @@ func (a *astConditionalStmt) Generate(p *program, b *generator) error {
 
 	if a.TypeAssertKind != nil {
 		// Allow type assertions to narrow the type of a union
-		if a.Cond.Comparison == nil && len(a.Cond.Sum.Terms) == 0 && len(a.Cond.Sum.Call.Calls) == 0 && a.Cond.Sum.Call.Base.Variable != nil {
+		if a.Cond.Comparison == nil && len(a.Cond.Sum.Terms) == 0 && len(a.Cond.Sum.Factors) == 0 && len(a.Cond.Sum.Call.Calls) == 0 && len(a.Cond.Sum.Call.Methods) == 0 && a.Cond.Sum.Call.Base.Variable != nil {
 			typeAssertVarName = *a.Cond.Sum.Call.Base.Variable
 			unionRegister = b.Locals[typeAssertVarName]
 			unionKind = b.Registers[unionRegister]
@@ -91,8 +96,7 @@ func (a *astConditionalStmt) Generate(p *program, b *generator) error {
 	}
 
 	parentCondition := b.CurrentCondition
-	trueCondition := b.NewCondition()
-	falseCondition := b.NewCondition()
+	trueCondition, falseCondition := b.NewBranch()
 	registers := make([]*Kind, len(b.Registers))
 	copy(registers, b.Registers)
 
@@ -108,20 +112,32 @@ func (a *astConditionalStmt) Generate(p *program, b *generator) error {
 			return err
 		}
 
-		overwrittenReg := b.NewReg(resolved, true)
-		b.Stmt(&genExtractUnionValue{unionRegister, overwrittenReg})
-		b.Locals[typeAssertVarName] = overwrittenReg
+		overwrittenReg := b.NewReg(narrowed(resolved, unionKind), true)
+		b.Stmt(&genExtractUnionValue{unionRegister, overwrittenReg, unionKind.Borrowed})
+		b.SetLocal(typeAssertVarName, overwrittenReg)
+		if err := consumeUnion(b, unionRegister, &a.Cond.Pos); err != nil {
+			return err
+		}
 	}
 
+	b.Terminated = false
 	if err := a.IfTrue.Generate(p, b); err != nil {
 		return err
 	}
+	trueReturned := b.Terminated
 
 	localsAfterTrue := b.Locals
 	b.Locals = localsBeforeTrue
+	registersAfterTrue := make([]*Kind, len(b.Registers))
+	copy(registersAfterTrue, b.Registers)
 	copy(b.Registers[:len(registers)], registers)
 	localsBeforeFalse := b.CopyOfLocals()
 
+	// Values created in the true branch don't exist in the false branch.
+	for i := len(registers); i < len(registersAfterTrue); i++ {
+		b.Registers[i] = nil
+	}
+
 	b.CurrentCondition = falseCondition
 
 	// If the union is composed of exactly two values, use the remaining one.
@@ -137,35 +153,66 @@ func (a *astConditionalStmt) Generate(p *program, b *generator) error {
 			leftover = unionTypeArgs[1]
 		}
 
-		overwrittenReg := b.NewReg(leftover, true)
-		b.Stmt(&genExtractUnionValue{unionRegister, overwrittenReg})
-		b.Locals[typeAssertVarName] = overwrittenReg
+		overwrittenReg := b.NewReg(narrowed(leftover, unionKind), true)
+		b.Stmt(&genExtractUnionValue{unionRegister, overwrittenReg, unionKind.Borrowed})
+		b.SetLocal(typeAssertVarName, overwrittenReg)
+		if err := consumeUnion(b, unionRegister, &a.Cond.Pos); err != nil {
+			return err
+		}
 	}
 
+	b.Terminated = false
 	if err := a.Otherwise.Generate(p, b); err != nil {
 		return err
 	}
+	falseReturned := b.Terminated
 
 	b.CurrentCondition = parentCondition
 
 	localsAfterFalse := b.Locals
 	b.Locals = localsBeforeFalse
+	copy(b.Registers[len(registers):], registersAfterTrue[len(registers):])
 
-	for name := range b.Locals {
-		regTrue, ok := localsAfterTrue[name]
-		if !ok {
-			delete(b.Locals, name)
-			continue
-		}
+	// Only branches that don't return carry on after the if-statement.
+	b.Terminated = trueReturned && falseReturned
+	if trueReturned {
+		b.Locals = localsAfterFalse
+		return nil
+	} else if falseReturned {
+		b.Locals = localsAfterTrue
+		copy(b.Registers[:len(registers)], registersAfterTrue[:len(registers)])
+		return nil
+	}
 
-		regFalse, ok := localsAfterFalse[name]
-		if !ok {
+	for _, name := range sortedNames(b.Locals) {
+		regTrue, okTrue := localsAfterTrue[name]
+		regFalse, okFalse := localsAfterFalse[name]
+
+		// Registers from before the if-statement now have their state after
+		// the false branch.
+		kindTrue := b.Registers[regTrue]
+		if int(regTrue) < len(registers) {
+			kindTrue = registersAfterTrue[regTrue]
+		}
+		kindFalse := b.Registers[regFalse]
+
+		if !okTrue || !okFalse {
+			// A variable consumed in one branch has to be dropped in the
+			// other, or it would be forgotten.
+			if okTrue {
+				err = dropInBranch(p, b, name, regTrue, kindTrue, trueCondition, a.IfTrue)
+			} else if okFalse {
+				err = dropInBranch(p, b, name, regFalse, kindFalse, falseCondition, a.Otherwise)
+			}
+			if err != nil {
+				return err
+			}
 			delete(b.Locals, name)
 			continue
 		}
 
-		if err := b.Registers[regTrue].IsEquivalent(*b.Registers[regFalse]); err != nil {
-			return fmt.Errorf("%s has unequal types on both sides of if-statement: %w", err)
+		if err := kindTrue.IsEquivalent(*kindFalse); err != nil {
+			return fmt.Errorf("%s has unequal types on both sides of if-statement: %w", name, err)
 		}
 
 		// If the variable is used on one side and not the other, make sure
@@ -173,20 +220,20 @@ func (a *astConditionalStmt) Generate(p *program, b *generator) error {
 		// dependencies on this variable wait until the condition is resolved.
 		if regTrue != regFalse {
 			if regTrue == localsAtStart[name] {
-				renamed := b.NewReg(b.Registers[regTrue], true)
-				b.Conditions = append(b.Conditions, stmtWithCondition{trueCondition, &genRenameRegister{regTrue, renamed}})
+				renamed := b.NewReg(kindTrue, true)
+				b.Conditions = append(b.Conditions, stmtWithCondition{trueCondition, &genRenameRegister{regTrue, renamed}, b.Pos})
 				regTrue = renamed
 			}
 
 			if regFalse == localsAtStart[name] {
-				renamed := b.NewReg(b.Registers[regFalse], true)
-				b.Conditions = append(b.Conditions, stmtWithCondition{falseCondition, &genRenameRegister{regFalse, renamed}})
+				renamed := b.NewReg(kindFalse, true)
+				b.Conditions = append(b.Conditions, stmtWithCondition{falseCondition, &genRenameRegister{regFalse, renamed}, b.Pos})
 				regFalse = renamed
 			}
 		}
 
 		b.JoinRegisters(regTrue, regFalse)
-		b.Locals[name] = regTrue
+		b.SetLocal(name, regTrue)
 	}
 
 	return nil
@@ -198,7 +245,7 @@ func (a *astExpressionBase) Captures(out map[string]bool) {
 			arg.Captures(out)
 		}
 	} else if a.Variable != nil {
-		if *a.Variable != "true" && *a.Variable != "false" {
+		if *a.Variable != "true" && *a.Variable != "false" && *a.Variable != "none" {
 			out[*a.Variable] = true
 		}
 	} else if a.Tuple != nil {
@@ -213,6 +260,12 @@ func (a *astExpressionBase) Captures(out map[string]bool) {
 }
 
 func (a *astExpressionBase) Generate(p *program, b *generator) ([]register, error) {
+	return a.GenerateExpecting(p, b, nil)
+}
+
+// GenerateExpecting generates this literal, using the expected kinds (if
+// known) to fill in types that can't be inferred from the literal alone.
+func (a *astExpressionBase) GenerateExpecting(p *program, b *generator, expected []*Kind) ([]register, error) {
 	if a.StructArguments != nil {
 		kind, err := p.ResolveType(&TypeRep{false, *a.Variable, nil})
 		if err != nil {
@@ -220,23 +273,32 @@ func (a *astExpressionBase) Generate(p *program, b *generator) ([]register, erro
 		}
 		fields := []register{}
 		expectedKinds := kind.UnpackAsTuple()
+		if len(a.StructArguments) != len(expectedKinds) {
+			return nil, fmt.Errorf("%s has %d fields, got %d", *a.Variable, len(expectedKinds), len(a.StructArguments))
+		}
 		for i, ast := range a.StructArguments {
-			regs, err := ast.Generate(p, b)
+			regs, err := ast.GenerateExpecting(p, b, expectedKinds[i:i+1])
 			if err != nil {
 				return nil, err
 			}
 			if len(regs) != 1 {
 				return nil, errors.New("Cannot use multi-variable value in tuple")
 			}
-			if err := b.Registers[regs[0]].CanConvertTo(*expectedKinds[i]); err != nil {
+			field, err := b.ConvertTo(regs[0], expectedKinds[i], &a.Pos)
+			if err != nil {
 				return nil, err
 			}
-			fields = append(fields, regs[0])
-			b.Consume(regs[0], &a.Pos)
+			fields = append(fields, field)
+			b.Consume(field, &a.Pos)
 		}
 
-		result := b.NewReg(&Kind{false, FamilyTuple, expectedKinds, *a.Variable}, true)
+		constructed := *kind
+		constructed.Borrowed = false
+		result := b.NewReg(&constructed, true)
 		b.Stmt(&genMakeTuple{Inputs: fields, Result: result})
+		if err := b.EndBorrows(fields...); err != nil {
+			return nil, err
+		}
 		return []register{result}, nil
 
 	} else if a.Variable != nil {
@@ -250,6 +312,16 @@ func (a *astExpressionBase) Generate(p *program, b *generator) ([]register, erro
 			return []register{reg}, nil
 		}
 
+		if *a.Variable == "none" {
+			kind, err := p.ResolveType(&TypeRep{false, "None", nil})
+			if err != nil {
+				return nil, err
+			}
+			reg := b.NewReg(kind, true)
+			b.Stmt(&genIntegerLiteral{reg, 0})
+			return []register{reg}, nil
+		}
+
 		if v, ok := b.Locals[*a.Variable]; ok {
 			return []register{v}, nil
 		}
@@ -264,14 +336,46 @@ func (a *astExpressionBase) Generate(p *program, b *generator) ([]register, erro
 		return []register{reg}, nil
 
 	} else if a.Integer != nil {
-		reg := b.NewReg(p.MustResolveBuiltinType("Integer"), true)
-		b.Stmt(&genIntegerLiteral{reg, *a.Integer})
+		kind := p.MustResolveBuiltinType("Integer")
+		if len(expected) == 1 && expected[0] != nil && expected[0].IsNumeric() {
+			// Literals take on the numeric type that is expected of them.
+			copied := *expected[0]
+			copied.Borrowed = false
+			kind = &copied
+		}
+		reg := b.NewReg(kind, true)
+		if kind.Family == FamilyFloat64 {
+			value, err := strconv.ParseFloat(*a.Integer, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s is out of range for %s", *a.Integer, kind)
+			}
+			b.Stmt(&genFloatLiteral{reg, value})
+			return []register{reg}, nil
+		}
+		value, err := parseIntegerLiteral(*a.Integer, kind)
+		if err != nil {
+			return nil, err
+		}
+		b.Stmt(&genIntegerLiteral{reg, value})
+		return []register{reg}, nil
+
+	} else if a.Float != nil {
+		reg := b.NewReg(p.MustResolveBuiltinType("Float64"), true)
+		b.Stmt(&genFloatLiteral{reg, *a.Float})
 		return []register{reg}, nil
 
+	} else if len(a.Tuple) == 1 {
+		// A single parenthesized expression.
+		return a.Tuple[0].GenerateExpecting(p, b, expected)
+
 	} else if a.Tuple != nil {
 		result := []register{}
-		for _, ast := range a.Tuple {
-			regs, err := ast.Generate(p, b)
+		for i, ast := range a.Tuple {
+			var hint []*Kind
+			if len(expected) == len(a.Tuple) {
+				hint = expected[i : i+1]
+			}
+			regs, err := ast.GenerateExpecting(p, b, hint)
 			if err != nil {
 				return nil, err
 			}
@@ -285,8 +389,12 @@ func (a *astExpressionBase) Generate(p *program, b *generator) ([]register, erro
 	} else if a.IsArray {
 		result := []register{}
 		kind := (*Kind)(nil)
+		var hint []*Kind
+		if len(expected) == 1 && expected[0] != nil && expected[0].Family == FamilyArray {
+			hint = expected[0].TupleOrUnionArgs
+		}
 		for _, ast := range a.Array {
-			regs, err := ast.Generate(p, b)
+			regs, err := ast.GenerateExpecting(p, b, hint)
 			if err != nil {
 				return nil, err
 			}
@@ -301,8 +409,20 @@ func (a *astExpressionBase) Generate(p *program, b *generator) ([]register, erro
 			}
 			result = append(result, regs[0])
 		}
-		reg := b.NewReg(&Kind{false, FamilyArray, []*Kind{kind}, "Array"}, true)
+		if kind == nil && len(hint) == 1 {
+			kind = hint[0]
+		}
+		if kind == nil {
+			return nil, errors.New("cannot infer the element type of an empty array literal")
+		}
+		reg := b.NewReg(&Kind{Family: FamilyArray, TupleOrUnionArgs: []*Kind{kind}, Label: "Array"}, true)
 		b.Stmt(&genNewArray{reg, result})
+		for _, element := range result {
+			b.Consume(element, &a.Pos)
+		}
+		if err := b.EndBorrows(result...); err != nil {
+			return nil, err
+		}
 		return []register{reg}, nil
 
 	} else {
@@ -311,51 +431,285 @@ func (a *astExpressionBase) Generate(p *program, b *generator) ([]register, erro
 }
 
 func (a *astMethodArg) Captures(out map[string]bool) {
-	if a.Borrow != nil {
-		out[*a.Borrow] = true
+	if a.InOut != nil {
+		out[*a.InOut] = true
+	} else if a.Shared != nil {
+		out[*a.Shared] = true
 	} else {
 		a.Expr.Captures(out)
 	}
 }
 
-func (a *astMethodArg) Generate(p *program, b *generator) (reg register, borrow string, err error) {
-	if a.Borrow != nil {
+func (a *astMethodArg) Generate(p *program, b *generator, expected *Kind) (reg register, borrow string, err error) {
+	if a.InOut != nil {
 		var ok bool
-		if reg, ok = b.Locals[*a.Borrow]; !ok {
-			err = fmt.Errorf("Cannot borrow non-existing local variable %s", *a.Borrow)
+		if reg, ok = b.Locals[*a.InOut]; !ok {
+			err = fmt.Errorf("Cannot borrow non-existing local variable %s", *a.InOut)
 			return
 		}
-		borrow = *a.Borrow
+		borrow = *a.InOut
 	} else {
-		var regs []register
-		if regs, err = a.Expr.Generate(p, b); err != nil {
-			return
+		if a.Shared != nil {
+			var ok bool
+			if reg, ok = b.Locals[*a.Shared]; !ok {
+				if pos, consumed := b.ConsumedLocals[*a.Shared]; consumed {
+					err = fmt.Errorf("cannot borrow consumed variable \"%s\" (was consumed at %s)", *a.Shared, pos)
+				} else {
+					err = fmt.Errorf("Cannot borrow non-existing local variable %s", *a.Shared)
+				}
+				return
+			}
+		} else {
+			var regs []register
+			if regs, err = a.Expr.GenerateExpecting(p, b, []*Kind{expected}); err != nil {
+				return
+			}
+			if len(regs) != 1 {
+				err = fmt.Errorf("multi argument value passed as function arg")
+				return
+			}
+			reg = regs[0]
 		}
-		if len(regs) != 1 {
-			err = fmt.Errorf("multi argument value passed as function arg")
-			return
+
+		if kind := b.Registers[reg]; expected != nil && kind.Family == FamilyShared {
+			if expected.Family != FamilyShared && expected.Borrowed {
+				// Borrow the value inside.
+				inner := *kind.TupleOrUnionArgs[0]
+				inner.Borrowed = true
+				view := b.NewReg(&inner, true)
+				b.Stmt(&genSharedValue{reg, view})
+				b.AddView(reg, view)
+				reg = view
+			} else if expected.Family == FamilyShared && !expected.Borrowed && b.IsLocal(reg) {
+				// Pass along a new reference, keeping this one.
+				copied := b.NewReg(kind, true)
+				b.Stmt(&genRetainShared{reg, copied})
+				b.Borrow(reg)
+				reg = copied
+			}
+		}
+
+		// Owned arguments are wrapped into unions as needed.
+		if expected != nil && !expected.Borrowed {
+			reg, err = b.ConvertTo(reg, expected, &a.Pos)
 		}
-		reg = regs[0]
 	}
 	return
 }
 
+// variable is the name of the variable that this argument passes as is, if
+// it is just a variable.
+func (a *astMethodArg) variable() (string, bool) {
+	if a.Expr == nil || a.Expr.Comparison != nil {
+		return "", false
+	}
+	sum := a.Expr.Sum
+	if len(sum.Factors) > 0 || len(sum.Terms) > 0 {
+		return "", false
+	}
+	call := sum.Call
+	if len(call.Calls) > 0 || len(call.Methods) > 0 || call.Propagate || call.Base.Variable == nil || call.Base.StructArguments != nil {
+		return "", false
+	}
+	return *call.Base.Variable, true
+}
+
+// checkBorrowedArgs makes sure that the arguments of a call don't alias. An
+// in-out argument ("&mut x") is exclusive: x is moved into the call and
+// rebound to the matching result, so no other argument may read it, not even
+// as a read-only borrow. A shared borrow ("&x") can only be passed as a
+// borrowed parameter, and x can't be moved into the same call.
+func checkBorrowedArgs(callee *astFunction, args []*astMethodArg) error {
+	inOut := map[string]bool{}
+	shared := map[string]bool{}
+	for i, arg := range args {
+		if arg.Shared != nil {
+			name := *arg.Shared
+			if kind := callee.Args[i].Kind; !kind.Borrowed {
+				return fmt.Errorf("%s takes argument %s by value, so &%s cannot be borrowed; pass %s to move it, or &mut %s to update it", callee.Name, callee.Args[i].label(i), name, name, name)
+			}
+			shared[name] = true
+			continue
+		}
+		if arg.InOut == nil {
+			continue
+		}
+		name := *arg.InOut
+		if inOut[name] {
+			return fmt.Errorf("&mut %s is passed more than once", name)
+		}
+		inOut[name] = true
+		if i >= len(callee.ReturnKind) {
+			return fmt.Errorf("%s does not return argument %s, so &mut %s cannot be passed", callee.Name, callee.Args[i].label(i), name)
+		}
+	}
+
+	for i, arg := range args {
+		if arg.InOut != nil {
+			continue
+		}
+		if name, ok := arg.variable(); ok && shared[name] && !callee.Args[i].Kind.Borrowed {
+			return fmt.Errorf("%s is borrowed (&%s), so it cannot also be moved by another argument", name, name)
+		}
+		captures := map[string]bool{}
+		arg.Captures(captures)
+		names := []string{}
+		for name := range captures {
+			if inOut[name] {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			return fmt.Errorf("%s is passed in-out (&mut %s), so it cannot also be used by another argument", names[0], names[0])
+		}
+	}
+	return nil
+}
+
+// parseIntegerLiteral reads a literal of the given kind. A UInt64 above the
+// largest Int64 is kept as the Int64 with the same bits.
+func parseIntegerLiteral(literal string, kind *Kind) (int64, error) {
+	if kind.Label == "UInt64" {
+		value, err := strconv.ParseUint(literal, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s is out of range for %s", literal, kind)
+		}
+		return int64(value), nil
+	}
+	bits := 64
+	if kind.Label == "Int32" {
+		bits = 32
+	}
+	value, err := strconv.ParseInt(literal, 10, bits)
+	if err != nil {
+		return 0, fmt.Errorf("%s is out of range for %s", literal, kind)
+	}
+	return value, nil
+}
+
+// buildBox moves a value into a new Box, or back out of one. Unlike other
+// functions, these work with any type.
+func buildBox(p *program, b *generator, name string, args []*astMethodArg, expected []*Kind) ([]register, error) {
+	if len(args) != 1 || args[0].InOut != nil || args[0].Shared != nil {
+		return nil, fmt.Errorf("%s takes exactly one value", name)
+	}
+
+	var hint *Kind
+	if name == "box" && len(expected) == 1 && expected[0] != nil && expected[0].Family == FamilyBox {
+		hint = expected[0].TupleOrUnionArgs[0]
+	}
+
+	input, _, err := args[0].Generate(p, b, hint)
+	if err != nil {
+		return nil, err
+	}
+	kind := b.Registers[input]
+	if kind.Borrowed {
+		return nil, fmt.Errorf("%s needs an owned value, got %s", name, kind)
+	}
+
+	var result register
+	if name == "box" {
+		result = b.NewReg(&Kind{Family: FamilyBox, TupleOrUnionArgs: []*Kind{kind}, Label: "Box"}, true)
+		b.Stmt(&genMakeBox{input, result})
+	} else if kind.Family == FamilyBox {
+		result = b.NewReg(kind.TupleOrUnionArgs[0], true)
+		b.Stmt(&genUnbox{input, result})
+	} else {
+		return nil, fmt.Errorf("unbox needs a Box, got %s", kind)
+	}
+	b.Consume(input, &args[0].Pos)
+	if err := b.EndBorrows(input); err != nil {
+		return nil, err
+	}
+	return []register{result}, nil
+}
+
+// buildShare freezes a value into a Shared one, which can be passed to any
+// number of calls and is freed along with its last reference.
+func buildShare(p *program, b *generator, args []*astMethodArg, expected []*Kind) ([]register, error) {
+	if len(args) != 1 || args[0].InOut != nil || args[0].Shared != nil {
+		return nil, fmt.Errorf("share takes exactly one value")
+	}
+
+	var hint *Kind
+	if len(expected) == 1 && expected[0] != nil && expected[0].Family == FamilyShared {
+		hint = expected[0].TupleOrUnionArgs[0]
+	}
+
+	input, _, err := args[0].Generate(p, b, hint)
+	if err != nil {
+		return nil, err
+	}
+	kind := b.Registers[input]
+	if kind.Borrowed {
+		return nil, fmt.Errorf("share needs an owned value, got %s", kind)
+	}
+	if kind.NeedsToBeDeleted() && !kind.CanBeImplicitlyDeleted() {
+		return nil, fmt.Errorf("cannot share %s, since it can't be dropped implicitly", kind)
+	}
+
+	result := b.NewReg(&Kind{Family: FamilyShared, TupleOrUnionArgs: []*Kind{kind}, Label: "Shared"}, true)
+	b.Stmt(&genMakeShared{input, result})
+	b.Consume(input, &args[0].Pos)
+	if err := b.EndBorrows(input); err != nil {
+		return nil, err
+	}
+	return []register{result}, nil
+}
+
 func buildMethodCall(p *program, b *generator, calleeName string, args []*astMethodArg) ([]register, error) {
 	callee, ok := p.Functions[calleeName]
-	if !ok {
+	if trait, isMethod := p.TraitMethods[calleeName]; !ok && isMethod {
+		// The implementation is picked once the first argument's type is
+		// known; until then, the trait's declaration stands in for it.
+		for _, method := range p.Traits[trait].Methods {
+			if method.Name == calleeName {
+				callee = method
+			}
+		}
+	} else if !ok {
 		return []register{}, fmt.Errorf("no function %s", calleeName)
 	}
 
 	kinds := []*Kind{}
 	registers := []register{}
 	borrows := []string{}
+	consumed := []register{}
+
+	if len(args) != len(callee.Args) {
+		return nil, fmt.Errorf("Type error: argument count mismatch, expecting %d, got %d", len(callee.Args), len(args))
+	}
+
+	if err := checkBorrowedArgs(callee, args); err != nil {
+		return nil, err
+	}
 
 	for i, arg := range args {
-		reg, borrow, err := arg.Generate(p, b)
+		var expected *Kind
+		if !callee.IsGeneric(callee.Args[i].Kind) {
+			restore := p.BindTypeArgs(nil)
+			resolved, err := p.ResolveType(callee.Args[i].Kind)
+			restore()
+			if err != nil {
+				return nil, err
+			}
+			expected = resolved
+		}
+
+		reg, borrow, err := arg.Generate(p, b, expected)
 		if err != nil {
 			return nil, err
 		}
 
+		if _, ok := p.TraitMethods[callee.Name]; ok && i == 0 {
+			if calleeName, err = p.Implementation(callee.Name, b.Registers[reg]); err != nil {
+				return nil, err
+			}
+			callee = p.Functions[calleeName]
+		}
+
 		registers = append(registers, reg)
 		kinds = append(kinds, b.Registers[reg])
 		borrows = append(borrows, borrow)
@@ -364,14 +718,39 @@ func buildMethodCall(p *program, b *generator, calleeName string, args []*astMet
 		// function.
 		if !callee.Args[i].Kind.Borrowed {
 			b.Consume(reg, &arg.Pos)
+			consumed = append(consumed, reg)
 		}
 	}
 
+	var typeArgs map[string]*Kind
+	if len(callee.TypeParams) > 0 {
+		var err error
+		if typeArgs, err = callee.InferTypeArgs(p, kinds); err != nil {
+			return nil, err
+		}
+		if calleeName, err = callee.Instantiate(p, typeArgs); err != nil {
+			return nil, err
+		}
+	}
+
+	restore := p.BindTypeArgs(typeArgs)
 	resultKinds, err := callee.ReturnValue(p, kinds)
+	restore()
 	if err != nil {
 		return []register{}, err
 	}
 
+	for i, borrow := range borrows {
+		if borrow == "" {
+			continue
+		}
+		owned := *kinds[i]
+		owned.Borrowed = false
+		if err := resultKinds[i].CanConvertTo(owned); err != nil {
+			return nil, fmt.Errorf("in-out argument &mut %s is returned as a different type: %w", borrow, err)
+		}
+	}
+
 	for len(borrows) < len(resultKinds) {
 		borrows = append(borrows, "")
 	}
@@ -384,13 +763,33 @@ func buildMethodCall(p *program, b *generator, calleeName string, args []*astMet
 	if callee.IsSynchronous {
 		b.Stmt(&genCallSyncFunction{calleeName, registers, results})
 	} else {
-		b.Stmt(&genCallAsyncFunction{calleeName, registers, results, b.NewChildCall(calleeName)})
+		b.Stmt(&genCallAsyncFunction{calleeName, registers, results, b.NewChildCall(calleeName), b.Pos.String()})
+	}
+	if err := b.EndBorrows(consumed...); err != nil {
+		return nil, err
+	}
+	for i, reg := range registers {
+		if callee.Args[i].Kind.Borrowed {
+			b.Borrow(reg)
+		}
+	}
+	for i, result := range results {
+		if !resultKinds[i].Borrowed {
+			continue
+		}
+		// A borrowed result (such as an element of an array) borrows from
+		// inside the arguments that were borrowed.
+		for j, reg := range registers {
+			if callee.Args[j].Kind.Borrowed {
+				b.AddView(reg, result)
+			}
+		}
 	}
 
 	actualResults := []register{}
 	for i, result := range results {
 		if borrows[i] != "" {
-			b.Locals[borrows[i]] = result
+			b.SetLocal(borrows[i], result)
 		} else {
 			actualResults = append(actualResults, result)
 		}
@@ -407,8 +806,12 @@ func (a *astExpression) Captures(out map[string]bool) {
 }
 
 func (a *astExpression) Generate(p *program, b *generator) ([]register, error) {
+	return a.GenerateExpecting(p, b, nil)
+}
+
+func (a *astExpression) GenerateExpecting(p *program, b *generator, expected []*Kind) ([]register, error) {
 	if a.Comparison == nil {
-		return a.Sum.Generate(p, b)
+		return a.Sum.GenerateExpecting(p, b, expected)
 	}
 
 	lhs, err := a.Sum.Generate(p, b)
@@ -418,48 +821,126 @@ func (a *astExpression) Generate(p *program, b *generator) ([]register, error) {
 	if len(lhs) != 1 {
 		return nil, fmt.Errorf("expecting single valued lhs %v", lhs)
 	}
-	if !b.Registers[lhs[0]].IsNumeric() {
+	left := b.Registers[lhs[0]]
+	if !left.IsNumeric() {
 		return nil, fmt.Errorf("expecting number on LHS")
 	}
 
-	rhs, err := a.Comparison.Operand.Generate(p, b)
+	rhs, err := a.Comparison.Operand.GenerateExpecting(p, b, []*Kind{left})
 	if err != nil {
 		return nil, err
 	}
 	if len(rhs) != 1 {
 		return nil, fmt.Errorf("expecting single valued rhs %v", rhs)
 	}
-	if !b.Registers[rhs[0]].IsNumeric() {
+	right := b.Registers[rhs[0]]
+	if !right.IsNumeric() {
 		return nil, fmt.Errorf("expecting number on RHS")
 	}
+	if left.Family != right.Family || left.Label != right.Label {
+		return nil, fmt.Errorf("cannot compare %s with %s", left, right)
+	}
 
 	result := b.NewReg(p.MustResolveBuiltinType("Boolean"), true)
-	b.Stmt(&genIntegerComparison{Operation: a.Comparison.Cond, Left: lhs[0], Right: rhs[0], Result: result})
+	b.Stmt(&genNumericComparison{Operation: a.Comparison.Cond, Left: lhs[0], Right: rhs[0], Result: result, Kind: left})
 	return []register{result}, nil
 }
 
 func (a *astExpressionSum) Captures(out map[string]bool) {
 	a.Call.Captures(out)
+	for _, factor := range a.Factors {
+		factor.Operand.Captures(out)
+	}
 	for _, term := range a.Terms {
 		term.Operand.Captures(out)
+		for _, factor := range term.Factors {
+			factor.Operand.Captures(out)
+		}
 	}
 }
 
 func (a *astExpressionSum) Generate(p *program, b *generator) ([]register, error) {
-	call := a.Call
+	return a.GenerateExpecting(p, b, nil)
+}
+
+func (a *astExpressionSum) GenerateExpecting(p *program, b *generator, expected []*Kind) ([]register, error) {
+	if len(a.Terms) == 0 && len(a.Factors) == 0 {
+		return a.Call.GenerateExpecting(p, b, expected)
+	}
+
+	// Operators are left associative, and the right hand side of each one is
+	// expected to have the same type as the left.
+	lhs, err := buildProduct(p, b, a.Call, a.Factors, expected)
+	if err != nil {
+		return nil, err
+	}
 	for _, term := range a.Terms {
-		c := "concat"
-		call = &astExpressionCall{
-			Base: &astExpressionBase{Variable: &c},
-			Calls: []*astMethodCall{{
-				Args: []*astMethodArg{
-					{Expr: &astExpression{Sum: &astExpressionSum{Call: call}}},
-					{Expr: &astExpression{Sum: &astExpressionSum{Call: term.Operand}}},
-				},
-			}},
+		rhs, err := buildProduct(p, b, term.Operand, term.Factors, []*Kind{b.Registers[lhs]})
+		if err != nil {
+			return nil, err
+		}
+		lhs, err = buildArithmetic(p, b, term.Op, lhs, rhs, &term.Pos)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []register{lhs}, nil
+}
+
+func buildProduct(p *program, b *generator, call *astExpressionCall, factors []*astFactor, expected []*Kind) (register, error) {
+	regs, err := call.GenerateExpecting(p, b, expected)
+	if err != nil {
+		return 0, err
+	}
+	if len(regs) != 1 {
+		return 0, fmt.Errorf("cannot use multi-variable value in arithmetic")
+	}
+	lhs := regs[0]
+	for _, factor := range factors {
+		regs, err := factor.Operand.GenerateExpecting(p, b, []*Kind{b.Registers[lhs]})
+		if err != nil {
+			return 0, err
+		}
+		if len(regs) != 1 {
+			return 0, fmt.Errorf("cannot use multi-variable value in arithmetic")
+		}
+		lhs, err = buildArithmetic(p, b, factor.Op, lhs, regs[0], &factor.Pos)
+		if err != nil {
+			return 0, err
 		}
 	}
-	return call.Generate(p, b)
+	return lhs, nil
+}
+
+// buildArithmetic applies a binary operator to two values. Adding Strings
+// concatenates them; otherwise both sides must be numbers of the same type.
+func buildArithmetic(p *program, b *generator, op string, lhs, rhs register, pos *lexer.Position) (register, error) {
+	left, right := b.Registers[lhs], b.Registers[rhs]
+
+	if op == "+" && left.Family == FamilyString {
+		if right.Family != FamilyString {
+			return 0, fmt.Errorf("cannot add %s to String", right)
+		}
+		owned := *p.MustResolveBuiltinType("String")
+		owned.Borrowed = false
+		result := b.NewReg(&owned, true)
+		b.Stmt(&genCallSyncFunction{"concat", []register{lhs, rhs}, []register{result}})
+		b.Borrow(lhs)
+		b.Borrow(rhs)
+		return result, nil
+	}
+
+	if !left.IsNumeric() || !right.IsNumeric() {
+		return 0, fmt.Errorf("cannot apply %s to %s and %s", op, left, right)
+	}
+	if left.Family != right.Family || left.Label != right.Label {
+		return 0, fmt.Errorf("mismatched types %s and %s", left, right)
+	}
+	kind := *left
+	kind.Borrowed = false
+	result := b.NewReg(&kind, true)
+	b.Stmt(&genArithmetic{Op: op, Left: lhs, Right: rhs, Result: result, Kind: &kind, Position: pos.String()})
+	return result, nil
 }
 
 func (a *astExpressionCall) Captures(out map[string]bool) {
@@ -469,18 +950,177 @@ func (a *astExpressionCall) Captures(out map[string]bool) {
 			arg.Captures(out)
 		}
 	}
+	for _, method := range a.Methods {
+		for _, arg := range method.Call.Args {
+			arg.Captures(out)
+		}
+	}
 }
 
 func (a *astExpressionCall) Generate(p *program, b *generator) ([]register, error) {
-	if len(a.Calls) == 0 {
-		return a.Base.Generate(p, b)
+	return a.GenerateExpecting(p, b, nil)
+}
+
+func (a *astExpressionCall) GenerateExpecting(p *program, b *generator, expected []*Kind) ([]register, error) {
+	var (
+		regs []register
+		err  error
+	)
+
+	propagate := a.Propagate
+	if n := len(a.Methods); n > 0 {
+		propagate = a.Methods[n-1].Propagate
+	}
+	if propagate {
+		// The expected kind is that of the unwrapped value.
+		expected = nil
 	}
 
-	if a.Base.Variable == nil || len(a.Calls) > 1 {
+	if n := len(a.Methods); n > 0 {
+		// The receiver is everything before the last method, and is passed
+		// as the first argument like any other expression.
+		method := a.Methods[n-1]
+		receiver := &astExpressionCall{Base: a.Base, Calls: a.Calls, Propagate: a.Propagate, Methods: a.Methods[:n-1], Pos: a.Pos}
+		args := append([]*astMethodArg{{Expr: &astExpression{Sum: &astExpressionSum{Call: receiver}}, Pos: a.Pos}}, method.Call.Args...)
+		regs, err = buildCall(p, b, method.Name, args, expected)
+	} else if len(a.Calls) == 0 {
+		regs, err = a.Base.GenerateExpecting(p, b, expected)
+	} else if a.Base.Variable == nil || len(a.Calls) > 1 {
 		return []register{}, fmt.Errorf("calls of non-immediate functions are unimplemented")
+	} else {
+		regs, err = buildCall(p, b, *a.Base.Variable, a.Calls[0].Args, expected)
+	}
+
+	if err != nil || !propagate {
+		return regs, err
+	}
+	if len(regs) != 1 {
+		return nil, fmt.Errorf("? expects a single value, got %d", len(regs))
+	}
+	pos := a.Pos
+	if n := len(a.Methods); n > 0 {
+		pos = a.Methods[n-1].Pos
+	}
+	return buildPropagate(p, b, regs[0], &pos)
+}
+
+// buildCall calls the function called name, or one of the builtins that
+// aren't declared as functions.
+func buildCall(p *program, b *generator, name string, args []*astMethodArg, expected []*Kind) ([]register, error) {
+	if p.Functions[name] == nil && (name == "box" || name == "unbox") {
+		return buildBox(p, b, name, args, expected)
+	} else if p.Functions[name] == nil && name == "share" {
+		return buildShare(p, b, args, expected)
+	}
+	return buildMethodCall(p, b, name, args)
+}
+
+// buildPropagate narrows a Union[T, Error] (or an Option[T]) to T, returning
+// the failure to the caller if there is one. The rest of the function only
+// runs once the value is known to be a T.
+func buildPropagate(p *program, b *generator, union register, pos *lexer.Position) ([]register, error) {
+	kind := b.Registers[union]
+	if kind.Family != FamilyUnion || len(kind.UnpackAsUnion()) != 2 {
+		return nil, fmt.Errorf("? expects a union of a value and a failure, got %s", kind)
+	}
+	if kind.Borrowed {
+		return nil, fmt.Errorf("? cannot unpack unowned %s", kind)
+	}
+	if b.IsClosure {
+		return nil, errors.New("? cannot be used inside a loop")
+	}
+
+	options := kind.UnpackAsUnion()
+	failure := -1
+	for i, option := range options {
+		if option.IsFailure() {
+			failure = i
+		}
+	}
+	if failure < 0 {
+		return nil, fmt.Errorf("? expects a union including Error or None, got %s", kind)
+	}
+	success := 1 - failure
+
+	// Exactly one of our results must be able to hold the failure.
+	slot := -1
+	for i, result := range b.ReturnKind {
+		if !result.CanHold(*options[failure]) {
+			continue
+		}
+		if slot >= 0 {
+			return nil, fmt.Errorf("? cannot choose between results %d and %d of %s", slot, i, b.Name)
+		}
+		slot = i
+	}
+	if slot < 0 {
+		return nil, fmt.Errorf("? used in %s, which cannot return %s", b.Name, options[failure])
+	}
+
+	isFailure := b.NewReg(p.MustResolveBuiltinType("Boolean"), true)
+	b.Stmt(&genCheckUnionType{union, failure, isFailure})
+	failureCondition, successCondition := b.NewBranch()
+	b.Stmt(&genBranch{isFailure, failureCondition, successCondition})
+	b.Consume(union, pos)
+	if err := b.EndBorrows(union); err != nil {
+		return nil, err
+	}
+
+	// On failure, return early. Every other result is filled in by the one
+	// live local of the same type, so effects such as Streams are handed back
+	// to the caller unchanged.
+	b.CurrentCondition = failureCondition
+	firstFailureReg := len(b.Registers)
+	failureReg := b.NewReg(options[failure], true)
+	b.Stmt(&genExtractUnionValue{union, failureReg, false})
+
+	names := []string{}
+	for name := range b.Locals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	returnValues := []register{}
+	for i, result := range b.ReturnKind {
+		if i == slot {
+			reg, err := b.ConvertTo(failureReg, result, pos)
+			if err != nil {
+				return nil, err
+			}
+			returnValues = append(returnValues, reg)
+			continue
+		}
+
+		found := []string{}
+		for _, name := range names {
+			if b.Registers[b.Locals[name]].IsEquivalent(*result) == nil {
+				found = append(found, name)
+			}
+		}
+		if len(found) != 1 {
+			return nil, fmt.Errorf("? needs exactly one local of type %s to return, found %v", result, found)
+		}
+		returnValues = append(returnValues, b.Locals[found[0]])
+	}
+
+	garbage, err := b.GarbageRegisters(returnValues)
+	if err != nil {
+		return nil, fmt.Errorf("cannot return early from %s: %w", b.Name, err)
+	}
+	b.Stmt(&genReturn{returnValues, garbage})
+	if err := b.EndBorrows(releasedRegisters(returnValues, garbage)...); err != nil {
+		return nil, err
+	}
+
+	// Registers created on the failure path are never visible afterwards.
+	for i := firstFailureReg; i < len(b.Registers); i++ {
+		b.Registers[i] = nil
 	}
 
-	return buildMethodCall(p, b, *a.Base.Variable, a.Calls[0].Args)
+	b.CurrentCondition = successCondition
+	value := b.NewReg(options[success], true)
+	b.Stmt(&genExtractUnionValue{union, value, false})
+	return []register{value}, nil
 }
 
 func (a *astLetStmt) Captures(out map[string]bool) {
@@ -488,70 +1128,228 @@ func (a *astLetStmt) Captures(out map[string]bool) {
 }
 
 func (a *astLetStmt) Generate(p *program, b *generator) error {
-	for _, name := range a.VarNames {
-		if _, ok := b.Locals[name]; ok != a.MustExist {
-			if a.MustExist {
-				return fmt.Errorf("Variable %s does not exist", name)
-			} else {
-				return fmt.Errorf("Variable %s already exists", name)
+	annotations := []*Kind{}
+	for _, binding := range a.Bindings {
+		if a.MustExist {
+			if binding.Pattern.Name == "" {
+				return fmt.Errorf("set only takes variable names")
+			}
+			if _, ok := b.Locals[binding.Pattern.Name]; !ok {
+				return fmt.Errorf("Variable %s does not exist", binding.Pattern.Name)
 			}
 		}
+
+		var annotation *Kind
+		if binding.Kind != nil {
+			resolved, err := p.ResolveType(binding.Kind)
+			if err != nil {
+				return err
+			}
+			annotation = resolved
+		}
+		annotations = append(annotations, annotation)
 	}
 
-	regs, err := a.Value.Generate(p, b)
+	regs, err := a.Value.GenerateExpecting(p, b, annotations)
 	if err != nil {
 		return err
 	}
 
-	if len(a.VarNames) == 1 {
+	if len(a.Bindings) == 1 {
 		// let a = (b, c)
-		regs = []register{b.MaybeMakeTuple(regs)}
+		tuple, err := b.MaybeMakeTuple(regs, &a.Value.Pos)
+		if err != nil {
+			return err
+		}
+		regs = []register{tuple}
+	}
+
+	if len(regs) == 1 && b.Registers[regs[0]].Family == FamilyTuple && len(a.Bindings) > 1 {
+		// let b, c = a
+		if regs, err = unpackTuple(b, regs[0], len(a.Bindings), &a.Value.Pos); err != nil {
+			return err
+		}
+	}
+
+	if len(regs) != len(a.Bindings) {
+		return fmt.Errorf("Arity mismatch: %d versus %d", len(regs), len(a.Bindings))
+	}
+
+	for i, binding := range a.Bindings {
+		if annotations[i] != nil {
+			// Annotations are checked, and may widen the value into a union.
+			if regs[i], err = b.ConvertTo(regs[i], annotations[i], &a.Value.Pos); err != nil {
+				return fmt.Errorf("%s: %w", binding.Pattern, err)
+			}
+		}
+		if err := binding.Pattern.Bind(p, b, regs[i], regs, a.MustExist); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *astPattern) String() string {
+	if a.Wildcard {
+		return "_"
+	} else if a.Tuple != nil {
+		parts := []string{}
+		for _, part := range a.Tuple {
+			parts = append(parts, part.String())
+		}
+		return "(" + strings.Join(parts, ", ") + ")"
 	}
+	return a.Name
+}
 
-	if len(regs) == 1 && b.Registers[regs[0]].Family == FamilyTuple && len(a.VarNames) > 1 {
-		// let (b, c) = a
-		original := regs[0]
+// Bind matches reg against this pattern, defining the variables in it. Values
+// is everything being bound by the same statement, which is kept alive even if
+// it shadows a variable.
+func (a *astPattern) Bind(p *program, b *generator, reg register, values []register, mustExist bool) error {
+	if a.Wildcard {
+		return ignore(p, b, reg, &a.Pos)
+	}
 
-		if b.Registers[original].Borrowed {
-			return fmt.Errorf("cannot unpack unowned tuple")
+	if a.Tuple != nil {
+		fields, err := unpackTuple(b, reg, len(a.Tuple), &a.Pos)
+		if err != nil {
+			return err
 		}
+		values = append(values, fields...)
+		for i, part := range a.Tuple {
+			if err := part.Bind(p, b, fields[i], values, mustExist); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !mustExist {
+		if err := shadow(p, b, a, values); err != nil {
+			return err
+		}
+	}
+	b.SetLocal(a.Name, reg)
+	b.BoundAt[a.Name] = &a.Pos
+	return nil
+}
+
+// unpackTuple moves each field of a tuple (or struct) into its own register.
+func unpackTuple(b *generator, reg register, count int, pos *lexer.Position) ([]register, error) {
+	kind := b.Registers[reg]
+	if kind.Family != FamilyTuple {
+		return nil, fmt.Errorf("cannot unpack %s into %d values", kind, count)
+	}
+	if len(kind.UnpackAsTuple()) != count {
+		return nil, fmt.Errorf("Arity mismatch: %d versus %d", len(kind.UnpackAsTuple()), count)
+	}
 
-		regs = []register{}
-		for _, kind := range b.Registers[original].UnpackAsTuple() {
-			regs = append(regs, b.NewReg(kind, true))
+	fields := []register{}
+	for _, field := range kind.UnpackAsTuple() {
+		if kind.Borrowed {
+			// The fields of a borrowed tuple are borrowed along with it.
+			borrowed := *field
+			borrowed.Borrowed = true
+			field = &borrowed
 		}
-		b.Stmt(&genUnpackTuple{
-			Input:   original,
-			Results: regs,
-		})
-		b.Consume(original, &a.Value.Pos)
+		fields = append(fields, b.NewReg(field, true))
 	}
+	b.Stmt(&genUnpackTuple{
+		Input:    reg,
+		Results:  fields,
+		Borrowed: kind.Borrowed,
+	})
+	if kind.Borrowed {
+		b.Borrow(reg)
+		for _, field := range fields {
+			b.AddView(reg, field)
+		}
+		return fields, nil
+	}
+	b.Consume(reg, pos)
+	if err := b.EndBorrows(reg); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
 
-	if len(regs) != len(a.VarNames) {
-		return fmt.Errorf("Arity mismatch: %d versus %d", len(regs), len(a.VarNames))
+// ignore drops a value matched by "_", which must be droppable.
+func ignore(p *program, b *generator, reg register, pos *lexer.Position) error {
+	kind := b.Registers[reg]
+	if !kind.NeedsToBeDeleted() {
+		return nil
+	}
+	if !kind.CanBeImplicitlyDeleted() {
+		return fmt.Errorf("_ would drop a %s, which can't be dropped implicitly", kind)
 	}
 
-	for i, varName := range a.VarNames {
-		b.Locals[varName] = regs[i]
+	done := b.NewReg(p.MustResolveBuiltinType("None"), true)
+	b.Stmt(&genDrop{reg, kind, done})
+	if err := b.EndBorrows(reg); err != nil {
+		return err
 	}
+	b.Consume(reg, pos)
+	return nil
+}
+
+// shadow drops the value of a variable that is about to be rebound by "let",
+// if it is still live. Effects such as Streams can't be dropped, so shadowing
+// them is an error.
+func shadow(p *program, b *generator, pattern *astPattern, values []register) error {
+	old, ok := b.Locals[pattern.Name]
+	if !ok {
+		return nil
+	}
+	for _, value := range values {
+		if b.ResolveRegister(value) == b.ResolveRegister(old) {
+			// let x = x
+			return nil
+		}
+	}
+
+	kind := b.Registers[old]
+	if !kind.NeedsToBeDeleted() {
+		return nil
+	}
+	if !kind.CanBeImplicitlyDeleted() {
+		bound := "earlier"
+		if pos := b.BoundAt[pattern.Name]; pos != nil {
+			bound = "at " + pos.String()
+		}
+		return fmt.Errorf("let %s at %s shadows a %s bound %s, which can't be dropped implicitly", pattern.Name, pattern.Pos, kind, bound)
+	}
+
+	done := b.NewReg(p.MustResolveBuiltinType("None"), true)
+	b.Stmt(&genDrop{old, kind, done})
+	if err := b.EndBorrows(old); err != nil {
+		return err
+	}
+	b.Consume(old, &pattern.Pos)
 	return nil
 }
 
 func (a *astReturnStmt) Captures(out map[string]bool) {
-	a.Value.Captures(out)
+	if a.Value != nil {
+		a.Value.Captures(out)
+	}
 }
 
 func (a *astReturnStmt) Generate(p *program, g *generator) error {
-	regs, err := a.Value.Generate(p, g)
-	if err != nil {
-		return err
+	// A bare "return" is for functions without results.
+	regs := []register{}
+	if a.Value != nil {
+		var err error
+		if regs, err = a.Value.GenerateExpecting(p, g, g.ReturnKind); err != nil {
+			return err
+		}
 	}
 
 	if len(g.ReturnKind) != len(regs) {
 		return fmt.Errorf("arg count mismatch: %d vs. %d", len(g.ReturnKind), len(regs))
 	}
 	for i, reg := range regs {
-		if err := g.Registers[reg].CanConvertTo(*g.ReturnKind[i]); err != nil {
+		var err error
+		if regs[i], err = g.ConvertTo(reg, g.ReturnKind[i], &a.Value.Pos); err != nil {
 			return err
 		}
 	}
@@ -562,9 +1360,68 @@ func (a *astReturnStmt) Generate(p *program, g *generator) error {
 	}
 
 	g.Stmt(&genReturn{regs, garbage})
+	if err := g.EndBorrows(releasedRegisters(regs, garbage)...); err != nil {
+		return err
+	}
+
+	// Nothing after a return runs, so every value is gone.
+	for _, reg := range releasedRegisters(regs, garbage) {
+		g.Consume(reg, &a.Pos)
+	}
+	for name := range g.Locals {
+		g.ConsumedLocals[name] = &a.Pos
+		delete(g.Locals, name)
+	}
+	g.Terminated = true
 	return nil
 }
 
+// narrowed is the kind of the value inside a union, which is only borrowed
+// if the union is.
+func narrowed(option, union *Kind) *Kind {
+	if !union.Borrowed {
+		return option
+	}
+	borrowed := *option
+	borrowed.Borrowed = true
+	return &borrowed
+}
+
+// consumeUnion marks a union as consumed once its value has been extracted,
+// which has to wait until every call borrowing it is done.
+func consumeUnion(b *generator, union register, pos *lexer.Position) error {
+	b.Consume(union, pos)
+	return b.EndBorrows(union)
+}
+
+// dropInBranch frees reg, the value of a variable that was consumed in the
+// other branch of an if-statement, at the end of the branch it survived.
+func dropInBranch(p *program, b *generator, name string, reg register, kind *Kind, cond condition, keptIn *astBlock) error {
+	if kind == nil || !kind.NeedsToBeDeleted() {
+		return nil
+	}
+	if !kind.CanBeImplicitlyDeleted() {
+		return fmt.Errorf("%s is consumed in one branch of the if-statement (at %s) but not in the other (at %s), and %s can't be dropped implicitly", name, b.ConsumedLocals[name], keptIn.Pos, kind)
+	}
+
+	done := b.NewReg(p.MustResolveBuiltinType("None"), true)
+	b.StmtWithCond(cond, &genDrop{reg, kind, done})
+	if err := b.EndBorrows(reg); err != nil {
+		return err
+	}
+	b.Consume(reg, &keptIn.EndPos)
+	return nil
+}
+
+func sortedNames(locals map[string]register) []string {
+	names := []string{}
+	for name := range locals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (a *astBlock) Captures(out map[string]bool) {
 	for _, stmt := range a.Statements {
 		stmt.Captures(out)
@@ -572,11 +1429,14 @@ func (a *astBlock) Captures(out map[string]bool) {
 }
 
 func (a *astBlock) Generate(p *program, g *generator) error {
+	outer := g.Pos
 	for _, stmt := range a.Statements {
+		g.Pos = stmt.Pos
 		if err := stmt.Generate(p, g); err != nil {
 			return fmt.Errorf("%s: %w", stmt.Pos, err)
 		}
 	}
+	g.Pos = outer
 	return nil
 }
 
@@ -630,8 +1490,13 @@ func (a *astRepeatStmt) Generate(p *program, g *generator) error {
 
 	captures := map[string]bool{}
 	a.Block.Captures(captures)
-
+	captured := []string{}
 	for name := range captures {
+		captured = append(captured, name)
+	}
+	sort.Strings(captured)
+
+	for _, name := range captured {
 		reg, ok := g.Locals[name]
 		if !ok {
 			continue
@@ -661,8 +1526,7 @@ func (a *astRepeatStmt) Generate(p *program, g *generator) error {
 			return fmt.Errorf("got multiple values for while condition")
 		}
 
-		continueCondition := closure.NewCondition()
-		exitCondition := closure.NewCondition()
+		continueCondition, exitCondition := closure.NewBranch()
 
 		returnVariables := []register{}
 		for i, lcl := range names {
@@ -683,13 +1547,18 @@ func (a *astRepeatStmt) Generate(p *program, g *generator) error {
 
 		closure.StmtWithCond(0, &genBranch{cond[0], continueCondition, exitCondition})
 		closure.StmtWithCond(continueCondition, &genRestartLoop{returnVariables, childCall, garbage})
+		if err := closure.EndBorrows(releasedRegisters(returnVariables, garbage)...); err != nil {
+			return err
+		}
 		closure.StmtWithCond(exitCondition, &genReturn{returnVariables, garbage})
+		if err := closure.EndBorrows(releasedRegisters(returnVariables, garbage)...); err != nil {
+			return err
+		}
 
 		closureName = closure.Name
 	}
 
-	startCondition := g.NewCondition()
-	skipCondition := g.NewCondition()
+	startCondition, skipCondition := g.NewBranch()
 
 	cond, err := a.Condition.Generate(p, g)
 	if err != nil {
@@ -700,34 +1569,145 @@ func (a *astRepeatStmt) Generate(p *program, g *generator) error {
 	}
 
 	g.Stmt(&genBranch{cond[0], startCondition, skipCondition})
-	g.StmtWithCond(startCondition, &genCallAsyncFunction{closureName, registers, resultRegisters, g.NewChildCall(closureName)})
+	g.StmtWithCond(startCondition, &genCallAsyncFunction{closureName, registers, resultRegisters, g.NewChildCall(closureName), g.Pos.String()})
+	if err := g.EndBorrows(registers...); err != nil {
+		return err
+	}
 
 	for i, name := range names {
 		before := g.Locals[name]
 		after := resultRegisters[i]
 
 		if err := g.Registers[before].IsEquivalent(*g.Registers[after]); err != nil {
-			return fmt.Errorf("%s changed type during loop: %w", err)
+			return fmt.Errorf("%s changed type during loop: %w", name, err)
 		}
 
 		g.Registers[before] = nil
 		g.StmtWithCond(skipCondition, &genRenameRegister{before, after})
-		g.Locals[name] = after
+		g.SetLocal(name, after)
+	}
+
+	return nil
+}
+
+// IsGeneric reports whether t mentions any of the type parameters of a (or
+// Self, in a trait).
+func (a *astFunction) IsGeneric(t *TypeRep) bool {
+	if t.Name == "Self" {
+		return true
+	}
+	for _, param := range a.TypeParams {
+		if t.Name == param.Name {
+			return true
+		}
+	}
+	for _, arg := range t.Args {
+		if a.IsGeneric(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// InferTypeArgs works out the type arguments of a generic function from the
+// kinds of the arguments it's called with, and checks that they implement
+// the required traits.
+func (a *astFunction) InferTypeArgs(p *program, kinds []*Kind) (map[string]*Kind, error) {
+	typeArgs := map[string]*Kind{}
+	for i, arg := range a.Args {
+		if err := a.unify(arg.Kind, kinds[i], typeArgs); err != nil {
+			return nil, err
+		}
+	}
+	for _, param := range a.TypeParams {
+		kind, ok := typeArgs[param.Name]
+		if !ok {
+			return nil, fmt.Errorf("can't infer type parameter %s of %s", param.Name, a.Name)
+		}
+		for _, trait := range param.Bounds {
+			if err := p.Implements(kind, trait); err != nil {
+				return nil, fmt.Errorf("%s can't be called with %s = %s: %w", a.Name, param.Name, kind, err)
+			}
+		}
+	}
+	return typeArgs, nil
+}
+
+func (a *astFunction) unify(t *TypeRep, kind *Kind, typeArgs map[string]*Kind) error {
+	if a.IsGeneric(t) && len(t.Args) == 0 {
+		owned := *kind
+		owned.Borrowed = false
+		if previous, ok := typeArgs[t.Name]; ok && previous.IsEquivalent(owned) != nil {
+			return fmt.Errorf("type parameter %s of %s is both %s and %s", t.Name, a.Name, previous, &owned)
+		}
+		typeArgs[t.Name] = &owned
+		return nil
 	}
 
+	// Anything else that doesn't line up is reported by ReturnValue.
+	args := kind.TupleOrUnionArgs
+	if kind.IsStruct() || len(args) < len(t.Args) {
+		return nil
+	}
+	for i, arg := range t.Args {
+		if err := a.unify(arg, args[i], typeArgs); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Instantiate generates a generic function for the given type arguments,
+// unless it has been already, returning the name of the generated function.
+// Every value is a val_t in C, so a native function has a single instance
+// for all of them.
+func (a *astFunction) Instantiate(p *program, typeArgs map[string]*Kind) (string, error) {
+	name := a.Name
+	if !a.IsNative {
+		name += "_"
+		for _, param := range a.TypeParams {
+			name += "_" + mangleKind(typeArgs[param.Name])
+		}
+	}
+	if p.instances[name] {
+		return name, nil
+	}
+	p.instances[name] = true
+
+	restore := p.BindTypeArgs(typeArgs)
+	defer restore()
+	return name, a.generateAs(p, name)
+}
+
+// label names the i-th argument in error messages, even if it's a pattern.
+func (a *astArg) label(i int) string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return fmt.Sprintf("%d", i+1)
+}
+
 func (a *astFunction) Generate(p *program) error {
+	return a.generateAs(p, a.Name)
+}
+
+func (a *astFunction) generateAs(p *program, name string) error {
 	argNames := []string{}
 	argKinds := []*Kind{}
-	for _, arg := range a.Args {
+	for i, arg := range a.Args {
 		resolved, err := p.ResolveType(arg.Kind)
 		if err != nil {
 			return err
 		}
 
-		argNames = append(argNames, arg.Name)
+		name := arg.Name
+		if arg.Pattern != nil {
+			// Unpacked below, under a name that can't clash with any other.
+			// (The AST is shared by every instance of a generic function, so
+			// it's left as is.)
+			name = fmt.Sprintf("_%d", i)
+		}
+		argNames = append(argNames, name)
 		argKinds = append(argKinds, resolved)
 	}
 
@@ -740,8 +1720,31 @@ func (a *astFunction) Generate(p *program) error {
 		resolvedReturn = append(resolvedReturn, resolved)
 	}
 
-	function := newGenerator(a.Name, p, argNames, argKinds, resolvedReturn)
+	if a.IsDestructor {
+		// Inside its own destructor, the value is just freed field by field.
+		inner := *argKinds[0]
+		inner.Destructor = ""
+		argKinds[0] = &inner
+	}
+
+	function := newGenerator(name, p, argNames, argKinds, resolvedReturn)
+	function.Pos = a.Pos
+	for i, arg := range a.Args {
+		function.BoundAt[argNames[i]] = &arg.Pos
+	}
 	function.IsNative = a.IsNative
+	function.IsDestructor = a.IsDestructor
+
+	for i, arg := range a.Args {
+		if arg.Pattern == nil {
+			continue
+		}
+		reg := function.Locals[argNames[i]]
+		delete(function.Locals, argNames[i])
+		if err := arg.Pattern.Bind(p, function, reg, nil, false); err != nil {
+			return err
+		}
+	}
 
 	if a.Block != nil {
 		if err := a.Block.Generate(p, function); err != nil {
@@ -0,0 +1,56 @@
+#!/bin/bash
+# Copyright 2021 Google LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+# Compares how many statements each call to a function checks against
+# scanning all of them, for a function with many statements that is woken up
+# once per tick.
+#
+# Usage: benchmarks/wakeups.sh [number of ticks]
+
+set -euo pipefail
+
+ticks="${1:-500}"
+root="$(cd "$(dirname "$0")/.." && pwd)"
+work="$(mktemp -d)"
+trap 'rm -rf "${work}"' EXIT
+
+mkdir -p "${work}/examples" "${work}/gen/sources"
+cp "${root}/examples/stdlib.ht" "${work}/examples/"
+cp "${root}/gen/builtins.h" "${work}/gen/"
+
+{
+  echo "import stdlib"
+  echo
+  echo "func tick(clock: Clock): Clock {"
+  echo "	sleep(&mut clock, 1)"
+  echo "	return clock"
+  echo "}"
+  echo
+  echo "func main(clock: Clock): Clock {"
+  echo "	let total = 0"
+  for i in $(seq "${ticks}"); do
+    echo "	tick(&mut clock)"
+    echo "	set total = total + ${i}"
+  done
+  echo "	return clock"
+  echo "}"
+} > "${work}/examples/wakeups.ht"
+
+(cd "${root}" && go build -o "${work}/unique_effect" ./unique_effect)
+(cd "${work}" && ./unique_effect wakeups)
+
+${CC:-clang} -o "${work}/wakeups" -DUNIQUE_EFFECT_STATS \
+  "${root}/gen/builtins.c" "${work}/gen/sources/wakeups.c"
+time "${work}/wakeups" > /dev/null
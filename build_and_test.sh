@@ -39,13 +39,94 @@ for features in '' '-DUSE_LIBUV -luv'; do
 
     module="$(basename "${filename}" .ht)"
 
-    unique_effect "${module}"
+    # Examples with an _error.txt file must be rejected by the compiler.
+    if [[ -f "examples/${module}_error.txt" ]]; then
+      if unique_effect "${module}" > "gen/outputs/${module}.txt"; then
+        echo "Expected ${module} to fail to compile"
+        exit 1
+      fi
+      diff -U 3 "gen/outputs/${module}.txt" "examples/${module}_error.txt"
+      continue
+    fi
+
+    # -emit-ir also checks that the IR reads back unchanged, and generates
+    # the C code from the IR as read back, so the diff below checks that the
+    # IR holds everything that the C code needs.
+    unique_effect -emit-ir "${module}"
+
+    # The generated C must not change unless the compiler does. Run with
+    # UPDATE_GOLDEN=1 to accept the new output.
+    if [[ "${UPDATE_GOLDEN:-}" == "1" ]]; then
+      cp "gen/sources/${module}.c" "examples/${module}_c.txt"
+    fi
+    diff -U 3 "gen/sources/${module}.c" "examples/${module}_c.txt"
+
+    # Examples with an _ir.txt file check the IR text format.
+    if [[ -f "examples/${module}_ir.txt" ]]; then
+      if [[ "${UPDATE_GOLDEN:-}" == "1" ]]; then
+        cp "gen/sources/${module}.ir" "examples/${module}_ir.txt"
+      fi
+      diff -U 3 "gen/sources/${module}.ir" "examples/${module}_ir.txt"
+    fi
+
+    # Examples with a _critical_path.txt file check -critical-path's estimate.
+    if [[ -f "examples/${module}_critical_path.txt" ]]; then
+      unique_effect -critical-path "${module}" \
+        2> "gen/outputs/${module}_critical_path.txt"
+      if [[ "${UPDATE_GOLDEN:-}" == "1" ]]; then
+        cp "gen/outputs/${module}_critical_path.txt" \
+          "examples/${module}_critical_path.txt"
+      fi
+      diff -U 3 "gen/outputs/${module}_critical_path.txt" \
+        "examples/${module}_critical_path.txt"
+    fi
+
     clang -Wall -Wpedantic -g -o "gen/binaries/${module}" -fsanitize=address \
+      -DUNIQUE_EFFECT_CHECKED \
       gen/builtins.c "gen/sources/${module}.c" ${features}
-    "gen/binaries/${module}" \
-      | tee "gen/outputs/${module}.txt"
+    # Examples with a _failure.txt file must stop with that runtime error.
+    if [[ -f "examples/${module}_failure.txt" ]]; then
+      if "gen/binaries/${module}" > "gen/outputs/${module}.txt" \
+          2> "gen/outputs/${module}_failure.txt"; then
+        echo "Expected ${module} to fail at runtime"
+        exit 1
+      fi
+      diff -U 3 "gen/outputs/${module}_failure.txt" "examples/${module}_failure.txt"
+    else
+      "gen/binaries/${module}" \
+        | tee "gen/outputs/${module}.txt"
+    fi
     diff -U 3 "gen/outputs/${module}.txt" "examples/${module}_output.txt"
   done
 done
 
+# The benchmark generates its own program, so make sure that still compiles.
+benchmarks/wakeups.sh 100
+
+# The iterations of sequential_loop run one after the other, so each one
+# reuses the state of the one before it instead of allocating its own.
+clang -Wall -Wpedantic -g -o gen/binaries/sequential_loop_stats \
+  -fsanitize=address -DUNIQUE_EFFECT_STATS \
+  gen/builtins.c gen/sources/sequential_loop.c
+stats="$(gen/binaries/sequential_loop_stats 2>&1 > /dev/null)"
+if [[ "${stats}" != *"999 loop iterations allocated 0 states"* ]]; then
+  echo "Expected sequential_loop to reuse its loop states, got:"
+  echo "${stats}"
+  exit 1
+fi
+
+# A traced build must write valid JSON with a source position on every event.
+clang -Wall -Wpedantic -g -o gen/binaries/cancellation_trace \
+  -fsanitize=address -DUNIQUE_EFFECT_TRACE \
+  gen/builtins.c gen/sources/cancellation.c
+UNIQUE_EFFECT_TRACE_FILE=gen/outputs/cancellation_trace.json \
+  gen/binaries/cancellation_trace > /dev/null
+python3 -c '
+import json, sys
+events = json.load(open(sys.argv[1]))
+missing = [e for e in events if not e["args"].get("position")]
+if not events or missing:
+    sys.exit("trace events without a position: %r" % missing)
+' gen/outputs/cancellation_trace.json
+
 echo -e "\033[1;32mOK\033[0m"
\ No newline at end of file
@@ -0,0 +1,491 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+// Statements wait for nothing but their inputs, so the time a program takes
+// can be estimated from its statements alone. FormatCriticalPath does that,
+// starting from main with all of its arguments ready at 0s:
+//
+//   - sleep(clock, n) takes n seconds, if n is a literal;
+//   - first(a, b) returns as soon as either clock is ready, since it cancels
+//     the other one;
+//   - a call to another function takes as long as that function does, given
+//     when its arguments are ready;
+//   - everything else takes no time.
+//
+// A function returns all of its results at once, so a function that returns
+// two effects (say a Clock and a Stream) holds back whichever was ready
+// first. Those are reported as entangled, since nothing else makes one wait
+// for the other; barrier in barriers.ht is an example.
+//
+// Calls that take an effect wait for the call before them that returned it.
+// When that is the only thing that orders the two, and it holds the second
+// call back, the pair is reported as serialised: the two sleeps on one clock
+// in barriers.ht are an example. join and first are left out, since waiting
+// for their clocks is what they are for.
+//
+// Loops are assumed to run once, and sleeps for a computed duration to take
+// no time, so the estimate is only a lower bound when there are either.
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// timing estimates when each statement in a call to a function finishes.
+type timing struct {
+	g      *generator
+	args   []float64
+	finish []float64 // by statement, or -1 if not estimated yet
+	// cause is the statement whose result a statement waited for last, or
+	// -1 if it waited only on arguments (or nothing).
+	cause []int
+
+	providers map[register][]int
+	branches  map[condition][]int
+	calls     map[int]*timing
+}
+
+// criticalPath estimates the timing of every call, starting from main.
+type criticalPath struct {
+	byName     map[string]*generator
+	active     map[string]bool
+	bound      bool // the estimate is only a lower bound
+	entangled  map[string]entanglement
+	serialised map[string]serialisation
+}
+
+// entanglement records a return statement that held an effect back until
+// another one was ready.
+type entanglement struct {
+	Function        string
+	Position        string
+	Held, WaitedFor string
+	Delay           float64
+}
+
+// serialisation records a call that waited for an earlier one only because
+// the earlier one returned an effect that it takes.
+type serialisation struct {
+	Pos, Earlier      lexer.Position
+	Name, EarlierName string
+	Effect            string
+	Delay             float64
+}
+
+// FormatCriticalPath writes how long main should take, the statements that it
+// waits for in order, and the effects that were serialised or entangled along
+// the way.
+func (p *program) FormatCriticalPath(w io.Writer) {
+	c := &criticalPath{
+		byName:     map[string]*generator{},
+		active:     map[string]bool{},
+		entangled:  map[string]entanglement{},
+		serialised: map[string]serialisation{},
+	}
+	for _, g := range p.GeneratedFunctions {
+		c.byName[g.Name] = g
+	}
+	main, ok := c.byName["main"]
+	if !ok {
+		return
+	}
+
+	t := c.call(main, make([]float64, len(main.ArgKinds)))
+	total, last := t.returned()
+
+	estimate := "takes"
+	if c.bound {
+		estimate = "takes at least"
+	}
+	fmt.Fprintf(w, "main %s %s\n", estimate, formatSeconds(total))
+	fmt.Fprintf(w, "critical path:\n")
+	t.formatPath(last, "  ", w)
+
+	if len(c.serialised) > 0 {
+		fmt.Fprintf(w, "serialised effects:\n")
+		serialised := []serialisation{}
+		for _, s := range c.serialised {
+			serialised = append(serialised, s)
+		}
+		sort.Slice(serialised, func(i, j int) bool {
+			a, b := serialised[i].Pos, serialised[j].Pos
+			if a.Filename != b.Filename {
+				return a.Filename < b.Filename
+			}
+			return a.Offset < b.Offset
+		})
+		for _, s := range serialised {
+			fmt.Fprintf(w, "  %s: %s waits %s for %s at %s, only because both use %s\n",
+				s.Pos, s.Name, formatSeconds(s.Delay), s.EarlierName, s.Earlier, s.Effect)
+		}
+	}
+
+	if len(c.entangled) > 0 {
+		fmt.Fprintf(w, "entangled effects:\n")
+		positions := []string{}
+		for position := range c.entangled {
+			positions = append(positions, position)
+		}
+		sort.Strings(positions)
+		for _, position := range positions {
+			e := c.entangled[position]
+			fmt.Fprintf(w, "  %s: %s holds %s back %s, until %s is ready\n",
+				e.Position, e.Function, e.Held, formatSeconds(e.Delay), e.WaitedFor)
+		}
+	}
+}
+
+// call estimates the timing of a call to g, given when its arguments are
+// ready.
+func (c *criticalPath) call(g *generator, args []float64) *timing {
+	t := &timing{
+		g:         g,
+		args:      args,
+		finish:    make([]float64, len(g.Conditions)),
+		cause:     make([]int, len(g.Conditions)),
+		providers: map[register][]int{},
+		branches:  map[condition][]int{},
+		calls:     map[int]*timing{},
+	}
+	for i, stmt := range g.Conditions {
+		t.finish[i] = -1
+		_, provides := stmt.Statement.Deps()
+		for _, reg := range provides {
+			reg = g.ResolveRegister(reg)
+			t.providers[reg] = append(t.providers[reg], i)
+		}
+		if branch, ok := stmt.Statement.(*genBranch); ok {
+			t.branches[branch.IfTrue] = append(t.branches[branch.IfTrue], i)
+			t.branches[branch.IfFalse] = append(t.branches[branch.IfFalse], i)
+		}
+		if _, ok := unwrapStatement(stmt.Statement).(*genRestartLoop); ok {
+			// Loops are counted as running once.
+			c.bound = true
+		}
+	}
+
+	// A function that calls itself is assumed to return right away the
+	// second time.
+	if c.active[g.Name] {
+		c.bound = true
+		return t
+	}
+	c.active[g.Name] = true
+	defer delete(c.active, g.Name)
+
+	for i := range g.Conditions {
+		c.statement(t, i)
+	}
+	return t
+}
+
+// returned is when the function returns, and which statement returns last.
+func (t *timing) returned() (float64, int) {
+	result, last := 0.0, -1
+	for i, stmt := range t.g.Conditions {
+		if _, ok := unwrapStatement(stmt.Statement).(*genReturn); ok && t.finish[i] >= result {
+			result, last = t.finish[i], i
+		}
+	}
+	if last < 0 {
+		// Never returns, or was only assumed to (see call).
+		result = maxOf(t.args)
+	}
+	return result, last
+}
+
+// statement estimates when statement i finishes, which is also when the
+// registers it provides are ready.
+func (c *criticalPath) statement(t *timing, i int) float64 {
+	if t.finish[i] >= 0 {
+		return t.finish[i]
+	}
+	t.finish[i] = 0 // in case of a cycle
+	g := t.g
+	stmt := g.Conditions[i]
+
+	// Conditions hold once the branches that lead to them are taken.
+	start, cause := 0.0, -1
+	wait := func(time float64, from int) {
+		if time > start || cause < 0 && time == start && from >= 0 {
+			start, cause = time, from
+		}
+	}
+	for cond := stmt.Cond; cond != 0; cond = g.ConditionParents[cond] {
+		for _, j := range t.branches[cond] {
+			wait(c.statement(t, j), j)
+		}
+	}
+
+	needs, _ := stmt.Statement.Deps()
+	if guarded, ok := stmt.Statement.(statementWithGuards); ok {
+		registers, _ := guarded.GuardDeps()
+		needs = append(append([]register{}, needs...), registers...)
+	}
+	call, isCall := unwrapStatement(stmt.Statement).(*genCallAsyncFunction)
+	if isCall {
+		needs = append(append([]register{}, needs...), call.Args...)
+	}
+	for _, need := range needs {
+		time, from := c.register(t, need)
+		wait(time, from)
+	}
+
+	t.finish[i] = start
+	t.cause[i] = cause
+	c.checkSerialised(t, i, needs)
+	if !isCall {
+		if ret, ok := unwrapStatement(stmt.Statement).(*genReturn); ok {
+			c.checkEntangled(t, i, ret)
+		}
+		return start
+	}
+
+	callee := c.byName[call.Name]
+	switch {
+	case call.Name == "sleep" && callee != nil && callee.IsNative:
+		duration, ok := c.literal(t, call.Args[1])
+		if !ok {
+			c.bound = true
+		}
+		t.finish[i] = start + duration
+	case call.Name == "first" && callee != nil && callee.IsNative:
+		// Whichever clock is ready first cancels the other.
+		first, from := c.register(t, call.Args[0])
+		if other, otherFrom := c.register(t, call.Args[1]); other < first {
+			first, from = other, otherFrom
+		}
+		t.finish[i], t.cause[i] = first, from
+	case callee != nil && !callee.IsNative:
+		args := []float64{}
+		for _, arg := range call.Args {
+			time, _ := c.register(t, arg)
+			args = append(args, time)
+		}
+		t.calls[i] = c.call(callee, args)
+		t.finish[i], _ = t.calls[i].returned()
+	}
+	return t.finish[i]
+}
+
+// register estimates when a register is ready, and which statement provides
+// it (or -1 for arguments).
+func (c *criticalPath) register(t *timing, reg register) (float64, int) {
+	reg = t.g.ResolveRegister(reg)
+	if int(reg) < len(t.args) {
+		return t.args[reg], -1
+	}
+	time, from := 0.0, -1
+	for _, j := range t.providers[reg] {
+		if finish := c.statement(t, j); finish >= time {
+			time, from = finish, j
+		}
+	}
+	if from < 0 {
+		// Only filled in by the next iteration of a loop.
+		c.bound = true
+	}
+	return time, from
+}
+
+// literal finds the value of an integer literal, in seconds.
+func (c *criticalPath) literal(t *timing, reg register) (float64, bool) {
+	for _, j := range t.providers[t.g.ResolveRegister(reg)] {
+		if literal, ok := unwrapStatement(t.g.Conditions[j].Statement).(*genIntegerLiteral); ok {
+			return float64(literal.Value), true
+		}
+	}
+	return 0, false
+}
+
+// checkEntangled notes effects that a return statement holds back. What main
+// returns is only waited for by the runtime, so it doesn't count.
+func (c *criticalPath) checkEntangled(t *timing, i int, ret *genReturn) {
+	g := t.g
+	if g.Name == "main" {
+		return
+	}
+	latest, waitedFor := -1.0, ""
+	for j, reg := range ret.ReturnValue {
+		kind := g.ReturnKind[j]
+		if !kind.CanBeArgumentToMain() {
+			continue
+		}
+		if time, _ := c.register(t, reg); time > latest {
+			latest, waitedFor = time, kind.String()
+		}
+	}
+	for j, reg := range ret.ReturnValue {
+		kind := g.ReturnKind[j]
+		time, _ := c.register(t, reg)
+		if !kind.CanBeArgumentToMain() || kind.String() == waitedFor || time >= latest {
+			continue
+		}
+		position := g.Conditions[i].Pos.String()
+		e := entanglement{g.Name, position, kind.String(), waitedFor, latest - time}
+		if previous, ok := c.entangled[position]; !ok || previous.Delay < e.Delay {
+			c.entangled[position] = e
+		}
+	}
+}
+
+// checkSerialised notes the effects that call i takes from an earlier call,
+// when nothing but the effect makes it wait for that call, and the wait
+// delays it. needs are the registers that statement i waits for.
+func (c *criticalPath) checkSerialised(t *timing, i int, needs []register) {
+	g := t.g
+	name, args := calleeOf(g.Conditions[i].Statement)
+	callee := c.byName[name]
+	if callee == nil || callee.IsNative && (name == "join" || name == "first") {
+		return
+	}
+	for k, arg := range args {
+		if k >= len(callee.ArgKinds) || !callee.ArgKinds[k].CanBeArgumentToMain() {
+			continue
+		}
+		time, earlier := c.register(t, arg)
+		if earlier < 0 {
+			continue
+		}
+		earlierName, _ := calleeOf(g.Conditions[earlier].Statement)
+		if earlierName == "" {
+			continue
+		}
+
+		// When would call i start without the effect, and does anything
+		// else it waits for come from the earlier call?
+		start, ordered := 0.0, false
+		for cond := g.Conditions[i].Cond; cond != 0; cond = g.ConditionParents[cond] {
+			for _, j := range t.branches[cond] {
+				start = maxOf([]float64{start, c.statement(t, j)})
+				ordered = ordered || t.dependsOn(j, earlier, map[int]bool{})
+			}
+		}
+		for _, need := range needs {
+			if g.ResolveRegister(need) == g.ResolveRegister(arg) {
+				continue
+			}
+			needed, from := c.register(t, need)
+			start = maxOf([]float64{start, needed})
+			ordered = ordered || from >= 0 && t.dependsOn(from, earlier, map[int]bool{})
+		}
+		if ordered || time <= start {
+			continue
+		}
+
+		effect, ok := g.Names[arg]
+		if !ok {
+			effect = callee.ArgKinds[k].String()
+		}
+		position := g.Conditions[i].Pos.String()
+		s := serialisation{g.Conditions[i].Pos, g.Conditions[earlier].Pos, name, earlierName, effect, time - start}
+		if previous, ok := c.serialised[position]; !ok || previous.Delay < s.Delay {
+			c.serialised[position] = s
+		}
+	}
+}
+
+// calleeOf returns the function that a statement calls and its arguments,
+// or "" if it isn't a call.
+func calleeOf(stmt generatedStatement) (string, []register) {
+	switch s := unwrapStatement(stmt).(type) {
+	case *genCallAsyncFunction:
+		return s.Name, s.Args
+	case *genCallSyncFunction:
+		return s.Name, s.Args
+	}
+	return "", nil
+}
+
+// dependsOn reports whether statement i waits for statement j, directly or
+// not.
+func (t *timing) dependsOn(i, j int, visited map[int]bool) bool {
+	if i == j {
+		return true
+	}
+	if visited[i] {
+		return false
+	}
+	visited[i] = true
+	stmt := t.g.Conditions[i]
+	needs, _ := stmt.Statement.Deps()
+	_, args := calleeOf(stmt.Statement)
+	for _, need := range append(append([]register{}, needs...), args...) {
+		for _, k := range t.providers[t.g.ResolveRegister(need)] {
+			if t.dependsOn(k, j, visited) {
+				return true
+			}
+		}
+	}
+	for cond := stmt.Cond; cond != 0; cond = t.g.ConditionParents[cond] {
+		for _, k := range t.branches[cond] {
+			if t.dependsOn(k, j, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// formatPath writes the statements that statement i waited for, in the
+// order they finished, and then statement i itself. Calls to other functions
+// are followed into the function.
+func (t *timing) formatPath(i int, indent string, w io.Writer) {
+	if i < 0 {
+		return
+	}
+	t.formatPath(t.cause[i], indent, w)
+	stmt := t.g.Conditions[i]
+	if isPure(stmt.Statement) {
+		return
+	}
+	fmt.Fprintf(w, "%s%6s  %s  %s\n", indent, formatSeconds(t.finish[i]), stmt.Pos, describeStatement(stmt.Statement))
+	if callee, ok := t.calls[i]; ok {
+		if _, last := callee.returned(); last >= 0 && callee.finish[last] > maxOf(callee.args) {
+			callee.formatPath(last, indent+"  ", w)
+		}
+	}
+}
+
+// describeStatement names a statement for the critical path: calls by the
+// function they call, and everything else by its kind.
+func describeStatement(stmt generatedStatement) string {
+	switch s := unwrapStatement(stmt).(type) {
+	case *genCallAsyncFunction:
+		return s.Name
+	case *genCallSyncFunction:
+		return s.Name
+	}
+	return irOpsByType[reflect.TypeOf(unwrapStatement(stmt))].tokens[0]
+}
+
+func formatSeconds(seconds float64) string {
+	return fmt.Sprintf("%0.1fs", seconds)
+}
+
+func maxOf(times []float64) float64 {
+	result := 0.0
+	for _, time := range times {
+		if time > result {
+			result = time
+		}
+	}
+	return result
+}
@@ -0,0 +1,252 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+// Every function in the program is generated, and every expression becomes a
+// statement, whether or not anything uses the result. RemoveDeadStatements
+// and PruneFunctions drop what isn't needed before the C code is written.
+
+// isPure reports whether a statement does nothing but fill in its results,
+// so that it can be removed when nobody reads them. Calls may have side
+// effects, and arithmetic can fail at runtime, so neither is pure.
+func isPure(stmt generatedStatement) bool {
+	switch unwrapStatement(stmt).(type) {
+	case *genStringLiteral, *genIntegerLiteral, *genFloatLiteral,
+		*genNumericComparison, *genNewArray, *genMakeTuple, *genUnpackTuple,
+		*genCheckUnionType, *genMakeUnion, *genExtractUnionValue,
+		*genMakeBox, *genUnbox, *genMakeShared, *genRetainShared,
+		*genSharedValue, *genRenameRegister:
+		return true
+	}
+	return false
+}
+
+// RemoveDeadStatements removes pure statements whose results are never read.
+//
+// Values that nothing reads are still listed as garbage, to be freed when the
+// function returns, and statements that consume borrowed values wait for
+// whatever borrowed them. Neither counts as reading a value, and both are
+// updated when the statement that computes it is removed. Statements that
+// consume an owned value are kept, since the value would leak otherwise.
+func (g *generator) RemoveDeadStatements() {
+	for {
+		reads := map[register]int{}
+		garbage := map[register]*Kind{}
+		for _, stmt := range g.Conditions {
+			for _, reg := range valuesRead(stmt.Statement) {
+				reads[g.ResolveRegister(reg)]++
+			}
+			for reg, kind := range garbageOf(stmt.Statement) {
+				garbage[g.ResolveRegister(reg)] = kind
+			}
+		}
+
+		dead := map[register]bool{}
+		kept := []stmtWithCondition{}
+		for _, stmt := range g.Conditions {
+			if g.isDead(stmt.Statement, reads, garbage) {
+				_, provides := stmt.Statement.Deps()
+				for _, reg := range provides {
+					dead[g.ResolveRegister(reg)] = true
+				}
+				continue
+			}
+			kept = append(kept, stmt)
+		}
+		if len(kept) == len(g.Conditions) {
+			return
+		}
+		g.Conditions = kept
+
+		for _, stmt := range g.Conditions {
+			g.forgetValues(stmt.Statement, dead)
+		}
+	}
+}
+
+func (g *generator) isDead(stmt generatedStatement, reads map[register]int, garbage map[register]*Kind) bool {
+	if !isPure(stmt) {
+		return false
+	}
+	needs, provides := stmt.Deps()
+	for _, reg := range provides {
+		if reads[g.ResolveRegister(reg)] > 0 {
+			return false
+		}
+	}
+	for i, reg := range needs {
+		kind := g.Registers[reg]
+		if kind == nil && len(provides) == 1 {
+			// Consumed values have no kind left, but values moved into
+			// another one still have the kind they have there.
+			kind = movedKind(unwrapStatement(stmt), i, garbage[g.ResolveRegister(provides[0])])
+		}
+		if kind == nil || kind.NeedsToBeDeleted() {
+			return false
+		}
+	}
+	return true
+}
+
+// movedKind is the kind of the i-th value that a statement moves into a
+// value of the given kind, if it does.
+func movedKind(stmt generatedStatement, i int, result *Kind) *Kind {
+	if result == nil {
+		return nil
+	}
+	switch s := stmt.(type) {
+	case *genMakeTuple:
+		return result.TupleOrUnionArgs[i]
+	case *genNewArray, *genMakeBox, *genMakeShared:
+		return result.TupleOrUnionArgs[0]
+	case *genMakeUnion:
+		return result.TupleOrUnionArgs[s.KindIndex]
+	}
+	return nil
+}
+
+// garbageOf lists the values that a statement frees if they were computed.
+func garbageOf(stmt generatedStatement) map[register]*Kind {
+	switch s := unwrapStatement(stmt).(type) {
+	case *genReturn:
+		return s.Garbage
+	case *genRestartLoop:
+		return s.Garbage
+	case *genInlineReturn:
+		return s.Garbage
+	}
+	return nil
+}
+
+// valuesRead lists the registers that a statement reads, which is everything
+// it refers to except for garbage and the values it waits on.
+func valuesRead(stmt generatedStatement) []register {
+	switch s := stmt.(type) {
+	case *genAfter:
+		return valuesRead(s.Statement)
+	case *genReturn:
+		return s.ReturnValue
+	case *genRestartLoop:
+		return s.Args
+	case *genCallAsyncFunction:
+		return s.Args
+	}
+	needs, _ := stmt.Deps()
+	return needs
+}
+
+// forgetValues removes registers that will never be filled in from the
+// garbage and waits of a statement.
+func (g *generator) forgetValues(stmt generatedStatement, dead map[register]bool) {
+	forget := func(garbage map[register]*Kind) {
+		for reg := range garbage {
+			if dead[g.ResolveRegister(reg)] {
+				delete(garbage, reg)
+			}
+		}
+	}
+
+	switch s := stmt.(type) {
+	case *genAfter:
+		waits := []borrowWait{}
+		for _, wait := range s.Waits {
+			if !dead[g.ResolveRegister(wait.Register)] {
+				waits = append(waits, wait)
+			}
+		}
+		s.Waits = waits
+		g.forgetValues(s.Statement, dead)
+	case *genReturn:
+		forget(s.Garbage)
+	case *genRestartLoop:
+		forget(s.Garbage)
+	case *genInlineReturn:
+		forget(s.Garbage)
+	}
+}
+
+// PruneFunctions removes functions that can't be reached from main, and
+// notes which structs are still used (so that only they get a function to
+// free them).
+func (p *program) PruneFunctions() {
+	byName := map[string]*generator{}
+	for _, g := range p.GeneratedFunctions {
+		byName[g.Name] = g
+	}
+
+	reached := map[string]bool{}
+	p.usedStructs = map[string]bool{}
+	visitedKinds := map[*Kind]bool{}
+
+	var visitFunction func(name string)
+	var visitKind func(kind *Kind)
+	visitKind = func(kind *Kind) {
+		if kind == nil || visitedKinds[kind] {
+			return
+		}
+		visitedKinds[kind] = true
+		if kind.IsStruct() {
+			p.usedStructs[kind.Label] = true
+		}
+		if kind.Destructor != "" {
+			visitFunction(kind.Destructor)
+		}
+		for _, arg := range kind.TupleOrUnionArgs {
+			visitKind(arg)
+		}
+	}
+	visitFunction = func(name string) {
+		g, ok := byName[name]
+		if !ok || reached[name] {
+			return
+		}
+		reached[name] = true
+
+		for _, kind := range g.Registers {
+			visitKind(kind)
+		}
+		for _, kind := range g.ArgKinds {
+			visitKind(kind)
+		}
+		for _, kind := range g.ReturnKind {
+			visitKind(kind)
+		}
+		for _, callee := range g.ChildCalls {
+			visitFunction(callee)
+		}
+		for _, stmt := range g.Conditions {
+			switch s := unwrapStatement(stmt.Statement).(type) {
+			case *genCallSyncFunction:
+				visitFunction(s.Name)
+			case *genCallAsyncFunction:
+				visitFunction(s.Name)
+			case *genDrop:
+				visitKind(s.Kind)
+			}
+			for _, kind := range garbageOf(stmt.Statement) {
+				visitKind(kind)
+			}
+		}
+	}
+	visitFunction("main")
+
+	kept := []*generator{}
+	for _, g := range p.GeneratedFunctions {
+		if reached[g.Name] {
+			kept = append(kept, g)
+		}
+	}
+	p.GeneratedFunctions = kept
+}
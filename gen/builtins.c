@@ -15,6 +15,7 @@
  */
 
 #include <assert.h>
+#include <inttypes.h>
 #include <stdbool.h>
 #include <stdint.h>
 #include <stdio.h>
@@ -26,6 +27,10 @@
 #include <uv.h>
 #endif
 
+#ifdef UNIQUE_EFFECT_TRACE_REAL_TIME
+#include <time.h>
+#endif
+
 #include "builtins.h"
 
 val_t kSingletonStream = (void *)40;
@@ -36,7 +41,6 @@ val_t kSingletonFileSystemWillFail = (void *)70;
 void unique_effect_runtime_schedule(struct unique_effect_runtime *rt,
                                     closure_t closure) {
   assert(closure.func != NULL);
-  assert(rt->next_call < 100);
 
   // Ignore duplicated calls to schedule the same function, as they can result
   // in use-after-free bugs.
@@ -47,15 +51,154 @@ void unique_effect_runtime_schedule(struct unique_effect_runtime *rt,
     }
   }
 
+  if (rt->next_call == rt->calls_capacity) {
+    rt->calls_capacity = 2 * rt->calls_capacity + 16;
+    rt->upcoming_calls = realloc(rt->upcoming_calls,
+                                 sizeof(closure_t) * rt->calls_capacity);
+    assert(rt->upcoming_calls != NULL);
+  }
   rt->upcoming_calls[rt->next_call] = closure;
   rt->next_call++;
 }
 
+void unique_effect_free_later(struct unique_effect_free_list *pending,
+                              unique_effect_free_fields_t free_fields,
+                              val_t value) {
+  if (pending->size == pending->capacity) {
+    pending->capacity = 2 * pending->capacity + 16;
+    pending->items = realloc(pending->items,
+                             sizeof(pending->items[0]) * pending->capacity);
+    assert(pending->items != NULL);
+  }
+  pending->items[pending->size].free_fields = free_fields;
+  pending->items[pending->size].value = value;
+  pending->size++;
+}
+
+void unique_effect_free_all(struct unique_effect_runtime *rt,
+                            struct unique_effect_free_list *pending) {
+  while (pending->size > 0) {
+    pending->size--;
+    pending->items[pending->size].free_fields(
+        rt, pending, pending->items[pending->size].value);
+  }
+  free(pending->items);
+}
+
+// The worklist is a binary heap, so that statements run in the order they
+// were written, like they would when scanning them all.
+void unique_effect_wake(int *worklist, int *size, bool *pending,
+                        int statement) {
+  if (pending[statement]) {
+    return;
+  }
+  pending[statement] = true;
+
+  int i = (*size)++;
+  while (i > 0 && worklist[(i - 1) / 2] > statement) {
+    worklist[i] = worklist[(i - 1) / 2];
+    i = (i - 1) / 2;
+  }
+  worklist[i] = statement;
+}
+
+int unique_effect_next_statement(int *worklist, int *size, bool *pending) {
+  int result = worklist[0];
+  int last = worklist[--*size];
+
+  int i = 0;
+  while (2 * i + 1 < *size) {
+    int child = 2 * i + 1;
+    if (child + 1 < *size && worklist[child + 1] < worklist[child]) {
+      child++;
+    }
+    if (last <= worklist[child]) {
+      break;
+    }
+    worklist[i] = worklist[child];
+    i = child;
+  }
+  worklist[i] = last;
+
+  pending[result] = false;
+  return result;
+}
+
+#ifdef UNIQUE_EFFECT_TRACE
+// trace_time is the timestamp of an event, in microseconds.
+static double trace_time(struct unique_effect_runtime *rt) {
+#ifdef UNIQUE_EFFECT_TRACE_REAL_TIME
+  struct timespec now;
+  clock_gettime(CLOCK_MONOTONIC, &now);
+  double seconds = now.tv_sec + now.tv_nsec / 1e9;
+  if (!rt->trace_started) {
+    rt->trace_start_time = seconds;
+  }
+  return (seconds - rt->trace_start_time) * 1e6;
+#else
+  return rt->current_time * 1e6;
+#endif
+}
+
+// trace_string writes s as a JSON string, escaping quotes, backslashes and
+// control characters (which can appear in file names).
+static void trace_string(FILE *trace, const char *s) {
+  fputc('"', trace);
+  for (; *s != '\0'; s++) {
+    if (*s == '"' || *s == '\\') {
+      fprintf(trace, "\\%c", *s);
+    } else if ((unsigned char)*s < 0x20) {
+      fprintf(trace, "\\u%04x", (unsigned char)*s);
+    } else {
+      fputc(*s, trace);
+    }
+  }
+  fputc('"', trace);
+}
+
+void unique_effect_trace(struct unique_effect_runtime *rt, char phase,
+                         const char *name, const void *id,
+                         const char *position, bool cancelled) {
+  double ts = trace_time(rt);
+  fprintf(rt->trace, "%s{\"name\": ", rt->trace_started ? ",\n" : "");
+  trace_string(rt->trace, name);
+  fprintf(rt->trace, ", \"ph\": \"%c\", \"ts\": %.3f, \"pid\": 1, \"tid\": 1",
+          phase, ts);
+  rt->trace_started = true;
+  if (phase == 'b' || phase == 'e') {
+    fprintf(rt->trace, ", \"cat\": \"call\", \"id\": \"%p\"", id);
+  } else if (phase == 'i') {
+    fprintf(rt->trace, ", \"s\": \"t\"");
+  }
+  fprintf(rt->trace, ", \"args\": {\"time\": %0.1f", rt->current_time);
+  if (position != NULL && position[0] != '\0') {
+    fprintf(rt->trace, ", \"position\": ");
+    trace_string(rt->trace, position);
+  }
+  if (cancelled) {
+    fprintf(rt->trace, ", \"cancelled\": true");
+  }
+  fprintf(rt->trace, "}}");
+}
+#endif
+
 void unique_effect_print(struct unique_effect_runtime *rt, val_t console,
                          val_t msg, val_t *console_out) {
   assert(console == kSingletonStream);
+#ifdef UNIQUE_EFFECT_TRACE
+  unique_effect_trace(rt, 'B', "print", NULL, rt->trace_position, false);
+#endif
   printf("%0.1fs %s\n", rt->current_time, (char *)msg);
   *console_out = console;
+#ifdef UNIQUE_EFFECT_TRACE
+  unique_effect_trace(rt, 'E', "print", NULL, rt->trace_position, false);
+#endif
+}
+
+void unique_effect_log(struct unique_effect_runtime *rt, val_t msg,
+                       val_t *result) {
+  printf("%0.1fs %s\n", rt->current_time, (char *)msg);
+  *result = NULL;
 }
 
 static void finish_current_iteration(struct unique_effect_runtime *rt) {
@@ -63,6 +206,10 @@ static void finish_current_iteration(struct unique_effect_runtime *rt) {
     rt->upcoming_calls[rt->current_call].func(
         rt, rt->upcoming_calls[rt->current_call].state);
   }
+
+  // Everything scheduled has run, so the queue can start over.
+  rt->current_call = 0;
+  rt->next_call = 0;
 }
 
 #ifdef USE_LIBUV
@@ -71,6 +218,9 @@ static void sleep_adapter_result(uv_timer_t *timer) {
   struct unique_effect_runtime *runtime = state->runtime;
 
   runtime->current_time = state->trigger_time;
+#ifdef UNIQUE_EFFECT_TRACE
+  unique_effect_trace(runtime, 'e', "sleep", state, state->position, false);
+#endif
 
   state->result[0]->value = kSingletonClock;
   state->result[0]->ready = true;
@@ -87,6 +237,9 @@ void unique_effect_sleep(struct unique_effect_runtime *rt,
                          struct unique_effect_sleep_state *state) {
   if (state->result[0]->cancelled && !state->r[0].cancelled) {
     state->r[0].cancelled = true;
+#ifdef UNIQUE_EFFECT_TRACE
+    unique_effect_trace(rt, 'e', "sleep", state, state->position, true);
+#endif
 
     // Cancel the pending timer.
 #ifdef USE_LIBUV
@@ -121,6 +274,9 @@ void unique_effect_sleep(struct unique_effect_runtime *rt,
 
   state->conditions[0] = true;
   state->trigger_time = rt->current_time + duration_in_seconds;
+#ifdef UNIQUE_EFFECT_TRACE
+  unique_effect_trace(rt, 'b', "sleep", state, state->position, false);
+#endif
 
 #ifdef USE_LIBUV
   state->timer.data = state;
@@ -154,7 +310,45 @@ void unique_effect_ReadLine(struct unique_effect_runtime *rt, val_t console,
 void unique_effect_itoa(struct unique_effect_runtime *rt, val_t int_val,
                         val_t *string_out) {
   *string_out = malloc(32);
-  snprintf(*string_out, 31, "%lu", (intptr_t)int_val);
+  snprintf(*string_out, 31, "%ld", (long)(intptr_t)int_val);
+}
+
+void unique_effect_itoa32(struct unique_effect_runtime *rt, val_t int_val,
+                          val_t *string_out) {
+  *string_out = malloc(32);
+  snprintf(*string_out, 31, "%" PRId32, (int32_t)(intptr_t)int_val);
+}
+
+void unique_effect_itoa64(struct unique_effect_runtime *rt, val_t int_val,
+                          val_t *string_out) {
+  *string_out = malloc(32);
+  snprintf(*string_out, 31, "%" PRId64, (int64_t)(intptr_t)int_val);
+}
+
+void unique_effect_utoa64(struct unique_effect_runtime *rt, val_t int_val,
+                          val_t *string_out) {
+  *string_out = malloc(32);
+  snprintf(*string_out, 31, "%" PRIu64, (uint64_t)(uintptr_t)int_val);
+}
+
+void unique_effect_ftoa(struct unique_effect_runtime *rt, val_t float_val,
+                        val_t *string_out) {
+  *string_out = malloc(32);
+  snprintf(*string_out, 31, "%g", unique_effect_double(float_val));
+}
+
+void unique_effect_overflow(const char *position) {
+#ifdef UNIQUE_EFFECT_CHECKED
+  fflush(stdout);
+  fprintf(stderr, "%s: runtime error: integer overflow\n", position);
+  abort();
+#endif
+}
+
+void unique_effect_division_by_zero(const char *position) {
+  fflush(stdout);
+  fprintf(stderr, "%s: runtime error: division by zero\n", position);
+  abort();
 }
 
 void unique_effect_concat(struct unique_effect_runtime *rt, val_t a, val_t b,
@@ -200,10 +394,16 @@ void unique_effect_first(struct unique_effect_runtime *runtime,
                          struct unique_effect_first_state *state) {
   if (state->r[0].ready && !state->r[1].ready && !state->r[1].cancelled) {
     state->r[1].cancelled = true;
+#ifdef UNIQUE_EFFECT_TRACE
+    unique_effect_trace(runtime, 'i', "first", state, state->position, true);
+#endif
     unique_effect_runtime_schedule(runtime, state->caller);
     return;
   } else if (state->r[1].ready && !state->r[0].ready && !state->r[0].cancelled) {
     state->r[0].cancelled = true;
+#ifdef UNIQUE_EFFECT_TRACE
+    unique_effect_trace(runtime, 'i', "first", state, state->position, true);
+#endif
     unique_effect_runtime_schedule(runtime, state->caller);
     return;
   }
@@ -214,6 +414,9 @@ void unique_effect_first(struct unique_effect_runtime *runtime,
 
   assert(state->r[0].value == kSingletonClock);
   assert(state->r[1].value == kSingletonClock);
+#ifdef UNIQUE_EFFECT_TRACE
+  unique_effect_trace(runtime, 'i', "first", state, state->position, false);
+#endif
 
   state->result[0]->value = kSingletonClock;
   state->result[0]->ready = true;
@@ -235,27 +438,79 @@ void unique_effect_append(struct unique_effect_runtime *rt,
                           struct unique_effect_array **ary_out) {
   if (ary->length == ary->capacity) {
     ary = realloc(ary, sizeof(struct unique_effect_array) +
-                           sizeof(val_t) * ary->capacity * 2 + 1);
+                           sizeof(val_t) * (ary->capacity * 2 + 1));
     ary->capacity = 2 * ary->capacity + 1;
   }
   ary->elements[ary->length++] = value;
   *ary_out = ary;
 }
 
-void unique_effect_debug(struct unique_effect_runtime *rt,
-                         struct unique_effect_array *ary, val_t *result_out) {
-  char *result = malloc(512);
-  result[0] = '[';
-  int length = 1;
-  for (int i = 0; i < ary->length; i++) {
-    length += snprintf(&result[length], 512 - length, i == 0 ? "%ld" : ", %ld",
-                       (intptr_t)ary->elements[i]);
+void unique_effect_length(struct unique_effect_runtime *rt,
+                          struct unique_effect_array *ary, val_t *result) {
+  *result = (void *)(intptr_t)ary->length;
+}
+
+void unique_effect_at(struct unique_effect_runtime *rt,
+                      struct unique_effect_array *ary, val_t index,
+                      val_t *result) {
+  intptr_t i = (intptr_t)index;
+  if (i < 0 || i >= ary->length) {
+    fflush(stdout);
+    fprintf(stderr, "runtime error: index %ld out of range for %d elements\n",
+            (long)i, ary->length);
+    abort();
   }
-  if (length < 512)
-    result[length++] = ']';
-  if (length < 512)
-    result[length++] = '\0';
-  *result_out = result;
+  *result = ary->elements[i];
+}
+
+void unique_effect_show_Integer(struct unique_effect_runtime *rt, val_t value,
+                                val_t *result) {
+  unique_effect_itoa(rt, value, result);
+}
+
+void unique_effect_show_Int32(struct unique_effect_runtime *rt, val_t value,
+                              val_t *result) {
+  unique_effect_itoa32(rt, value, result);
+}
+
+void unique_effect_show_Int64(struct unique_effect_runtime *rt, val_t value,
+                              val_t *result) {
+  unique_effect_itoa64(rt, value, result);
+}
+
+void unique_effect_show_UInt64(struct unique_effect_runtime *rt, val_t value,
+                               val_t *result) {
+  unique_effect_utoa64(rt, value, result);
+}
+
+void unique_effect_show_Float64(struct unique_effect_runtime *rt, val_t value,
+                                val_t *result) {
+  unique_effect_ftoa(rt, value, result);
+}
+
+void unique_effect_show_Boolean(struct unique_effect_runtime *rt, val_t value,
+                                val_t *result) {
+  *result = strdup(value ? "true" : "false");
+}
+
+void unique_effect_show_String(struct unique_effect_runtime *rt, val_t value,
+                               val_t *result) {
+  unique_effect_copy(rt, value, result);
+}
+
+void unique_effect_eq_Integer(struct unique_effect_runtime *rt, val_t a,
+                              val_t b, val_t *result) {
+  *result = (void *)(intptr_t)(a == b);
+}
+
+void unique_effect_eq_Boolean(struct unique_effect_runtime *rt, val_t a,
+                              val_t b, val_t *result) {
+  *result = (void *)(intptr_t)(a == b);
+}
+
+void unique_effect_eq_String(struct unique_effect_runtime *rt, val_t a, val_t b,
+                             val_t *result) {
+  *result = (void *)(intptr_t)(strcmp(a, b) == 0);
 }
 
 void unique_effect_mightfail(struct unique_effect_runtime *rt, val_t fs,
@@ -281,10 +536,23 @@ void unique_effect_reason(struct unique_effect_runtime *rt, val_t err,
 }
 
 void unique_effect_runtime_init(struct unique_effect_runtime *rt) {
+  rt->upcoming_calls = NULL;
+  rt->calls_capacity = 0;
   rt->next_call = 0;
   rt->next_timer = 0;
   rt->current_call = 0;
   rt->current_time = 0.0;
+#ifdef UNIQUE_EFFECT_STATS
+  memset(&rt->stats, 0, sizeof(rt->stats));
+#endif
+#ifdef UNIQUE_EFFECT_TRACE
+  const char *trace_file = getenv("UNIQUE_EFFECT_TRACE_FILE");
+  rt->trace = fopen(trace_file != NULL ? trace_file : "trace.json", "w");
+  assert(rt->trace != NULL);
+  fprintf(rt->trace, "[\n");
+  rt->trace_position = NULL;
+  rt->trace_started = false;
+#endif
 }
 
 void unique_effect_runtime_loop(struct unique_effect_runtime *runtime) {
@@ -306,21 +574,37 @@ void unique_effect_runtime_loop(struct unique_effect_runtime *runtime) {
           next_trigger_time = runtime->timers[i]->trigger_time;
         }
       }
+      if (next_trigger_time >= 0) {
+        runtime->current_time = next_trigger_time;
+      }
       for (int i = 0; i < runtime->next_timer; i++) {
         if (runtime->timers[i] == NULL ||
             runtime->timers[i]->trigger_time > next_trigger_time) {
           // timer has been cancelled or hasn't fired yet
           continue;
         }
+#ifdef UNIQUE_EFFECT_TRACE
+        unique_effect_trace(runtime, 'e', "sleep", runtime->timers[i],
+                            runtime->timers[i]->position, false);
+#endif
         unique_effect_runtime_schedule(runtime, runtime->timers[i]->caller);
         runtime->timers[i]->result[0]->value = kSingletonClock;
         runtime->timers[i]->result[0]->ready = true;
         free(runtime->timers[i]);
         runtime->timers[i] = NULL;
       }
-      if (next_trigger_time >= 0) {
-        runtime->current_time = next_trigger_time;
-      } else {
+      // Move the remaining timers down over the ones that just fired.
+      int live = 0;
+      for (int i = 0; i < runtime->next_timer; i++) {
+        if (runtime->timers[i] != NULL) {
+          runtime->timers[live] = runtime->timers[i];
+          runtime->timers[live]->pending_timer = &runtime->timers[live];
+          live++;
+        }
+      }
+      runtime->next_timer = live;
+
+      if (next_trigger_time < 0) {
         // There's nothing left to do, so free up all the completed slots
         // currently in the runtime.
         runtime->next_timer = 0;
@@ -332,5 +616,17 @@ void unique_effect_runtime_loop(struct unique_effect_runtime *runtime) {
 #endif
 
   printf("finished after %0.1fs\n", runtime->current_time);
+  free(runtime->upcoming_calls);
+#ifdef UNIQUE_EFFECT_TRACE
+  fprintf(runtime->trace, "\n]\n");
+  fclose(runtime->trace);
+#endif
+#ifdef UNIQUE_EFFECT_STATS
+  fprintf(stderr, "%ld wakeups checked %ld statements (a full scan checks %ld)\n",
+          runtime->stats.wakeups, runtime->stats.statements_checked,
+          runtime->stats.full_scan);
+  fprintf(stderr, "%ld loop iterations allocated %ld states\n",
+          runtime->stats.loop_iterations, runtime->stats.loop_frames);
+#endif
   assert(runtime->called_exit);
 }
@@ -17,12 +17,19 @@
 #ifndef __BUILTINS_H__
 #define __BUILTINS_H__
 
+#include <stdatomic.h>
 #include <stdbool.h>
+#include <stdint.h>
+#include <string.h>
 
 #ifdef USE_LIBUV
 #include <uv.h>
 #endif
 
+#ifdef UNIQUE_EFFECT_TRACE
+#include <stdio.h>
+#endif
+
 typedef void *val_t;
 typedef struct {
   val_t value;
@@ -37,7 +44,10 @@ typedef struct {
 } closure_t;
 
 struct unique_effect_runtime {
-  closure_t upcoming_calls[100];
+  // Calls that are ready to run, in order. The queue grows as needed, since
+  // dropping an array can schedule a destructor for each of its elements.
+  closure_t *upcoming_calls;
+  int calls_capacity;
   int next_call;
   int current_call;
 
@@ -47,12 +57,60 @@ struct unique_effect_runtime {
 
   bool called_exit;
   double current_time;
+
+#ifdef UNIQUE_EFFECT_STATS
+  // How often functions were called, how many statements they checked, and
+  // how many they would have had to check by scanning every statement. Also
+  // how many times loops went around, and how many states they allocated.
+  struct {
+    long wakeups, statements_checked, full_scan;
+    long loop_iterations, loop_frames;
+  } stats;
+#endif
+
+#ifdef UNIQUE_EFFECT_TRACE
+  // Where trace events go (see unique_effect_trace), and the source
+  // position of the statement that last called a native function.
+  FILE *trace;
+  const char *trace_position;
+  bool trace_started;
+  double trace_start_time;
+#endif
 };
 
+#ifdef UNIQUE_EFFECT_STATS
+#define UNIQUE_EFFECT_STAT(name, n) (rt->stats.name += (n))
+#else
+#define UNIQUE_EFFECT_STAT(name, n)
+#endif
+
+#ifdef UNIQUE_EFFECT_TRACE
+// Writes an event in Chrome's trace-event format to $UNIQUE_EFFECT_TRACE_FILE
+// (trace.json by default). 'B' and 'E' begin and end a call to a function,
+// 'b' and 'e' the asynchronous span from a call to its return (keyed by id),
+// and 'i' marks a moment. Times are virtual, as printed by the program, unless
+// compiled with -DUNIQUE_EFFECT_TRACE_REAL_TIME.
+void unique_effect_trace(struct unique_effect_runtime *rt, char phase,
+                         const char *name, const void *id,
+                         const char *position, bool cancelled);
+#define UNIQUE_EFFECT_TRACE_EVENT(phase, name, position, cancelled) \
+  unique_effect_trace(rt, (phase), (name), sp, (position), (cancelled))
+#define UNIQUE_EFFECT_TRACE_AT(position) (rt->trace_position = (position))
+#define UNIQUE_EFFECT_TRACE_CALLED_FROM(state, position_) \
+  ((state)->position = (position_))
+#else
+#define UNIQUE_EFFECT_TRACE_EVENT(phase, name, position, cancelled)
+#define UNIQUE_EFFECT_TRACE_AT(position)
+#define UNIQUE_EFFECT_TRACE_CALLED_FROM(state, position)
+#endif
+
 struct unique_effect_sleep_state {
   future_t r[2];
   future_t *result[1];
   closure_t caller;
+#ifdef UNIQUE_EFFECT_TRACE
+  const char *position; // of the call
+#endif
 
 #ifdef USE_LIBUV
   // Needed to get back into the event loop.
@@ -70,6 +128,9 @@ struct unique_effect_first_state {
   future_t r[2];
   future_t *result[2];
   closure_t caller;
+#ifdef UNIQUE_EFFECT_TRACE
+  const char *position; // of the call
+#endif
   bool conditions[1]; // needed for calling convention
 };
 
@@ -79,6 +140,32 @@ struct unique_effect_array {
   val_t elements[];
 };
 
+// A Shared value is freed when its last reference is dropped.
+struct unique_effect_shared {
+  atomic_intptr_t references;
+  val_t value;
+};
+
+// Structs whose fields are still to be freed, so that freeing a long list
+// doesn't recurse once per cell.
+struct unique_effect_free_list;
+typedef void (*unique_effect_free_fields_t)(struct unique_effect_runtime *rt,
+                                            struct unique_effect_free_list *pending,
+                                            val_t value);
+struct unique_effect_free_list {
+  struct {
+    unique_effect_free_fields_t free_fields;
+    val_t value;
+  } *items;
+  int size, capacity;
+};
+
+void unique_effect_free_later(struct unique_effect_free_list *pending,
+                              unique_effect_free_fields_t free_fields,
+                              val_t value);
+void unique_effect_free_all(struct unique_effect_runtime *rt,
+                            struct unique_effect_free_list *pending);
+
 extern val_t kSingletonStream;
 extern val_t kSingletonClock;
 extern val_t kSingletonFileSystem;
@@ -89,4 +176,27 @@ void unique_effect_runtime_schedule(struct unique_effect_runtime *rt,
 void unique_effect_runtime_loop(struct unique_effect_runtime *rt);
 void unique_effect_exit(struct unique_effect_runtime *rt, void *state);
 
+// The statements of a function that are waiting to be checked, popped in the
+// order they were written.
+void unique_effect_wake(int *worklist, int *size, bool *pending, int statement);
+int unique_effect_next_statement(int *worklist, int *size, bool *pending);
+
+// Float64 values are stored bit for bit in a val_t.
+static inline double unique_effect_double(val_t value) {
+  double result;
+  memcpy(&result, &value, sizeof(result));
+  return result;
+}
+
+static inline val_t unique_effect_from_double(double value) {
+  val_t result = NULL;
+  memcpy(&result, &value, sizeof(value));
+  return result;
+}
+
+// Runtime errors in arithmetic. Overflow only aborts in checked builds
+// (-DUNIQUE_EFFECT_CHECKED); otherwise the result wraps around.
+void unique_effect_overflow(const char *position);
+void unique_effect_division_by_zero(const char *position);
+
 #endif
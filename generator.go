@@ -18,29 +18,57 @@ import (
 	"fmt"
 	"github.com/alecthomas/participle/v2/lexer"
 	"io"
+	"sort"
+	"strings"
 )
 
 type stmtWithCondition struct {
 	Cond      condition
 	Statement generatedStatement
+	// Pos is the source statement that this one was generated for.
+	Pos lexer.Position
 }
 
 type generator struct {
 	Name           string
 	Conditions     []stmtWithCondition
 	Locals         map[string]register
+	Names          map[register]string
 	ConsumedLocals map[string]*lexer.Position
+	BoundAt        map[string]*lexer.Position
 	Results        int
 	Registers      []*Kind
 	IsNative       bool
+	IsClosure      bool
+	IsDestructor   bool
+	Terminated     bool // after a return statement
 	ArgKinds       []*Kind
 	ReturnKind     []*Kind
 	Substitutions  map[register]register
 	ChildCalls     []string
 	NextClosure    int
 
+	// Borrowers lists, for each register, the statements that read it
+	// without consuming it.
+	Borrowers         map[register][]int
+	Views             map[register][]register
+	ConditionParents  map[condition]condition
+	ConditionSiblings map[condition]condition
+
 	CurrentCondition condition
 	NextCondition    condition
+	// Pos is the source statement being generated, which every statement
+	// added to Conditions is attributed to.
+	Pos lexer.Position
+
+	// Shares lists registers that take turns using one slot in sp->r, in
+	// the order that they use it (see liveness.go). Each register but the
+	// last has a flag in sp->consumed.
+	Shares    [][]register
+	Consumed  int
+	slots     map[register]int
+	owners    map[register]slotOwner
+	frameSize int
 }
 
 func newGenerator(name string, program *program, argNames []string, argKinds []*Kind, results []*Kind) *generator {
@@ -48,7 +76,13 @@ func newGenerator(name string, program *program, argNames []string, argKinds []*
 	function.Name = name
 	function.Substitutions = map[register]register{}
 	function.Locals = map[string]register{}
+	function.Names = map[register]string{}
 	function.ConsumedLocals = map[string]*lexer.Position{}
+	function.BoundAt = map[string]*lexer.Position{}
+	function.Borrowers = map[register][]int{}
+	function.Views = map[register][]register{}
+	function.ConditionParents = map[condition]condition{}
+	function.ConditionSiblings = map[condition]condition{}
 	function.ArgKinds = argKinds
 	function.ReturnKind = results
 	function.Results = len(results)
@@ -58,13 +92,19 @@ func newGenerator(name string, program *program, argNames []string, argKinds []*
 
 	for i, arg := range argNames {
 		function.Registers = append(function.Registers, argKinds[i])
-		function.Locals[arg] = register(i)
+		function.SetLocal(arg, register(i))
 	}
 
 	program.GeneratedFunctions = append(program.GeneratedFunctions, function)
 	return function
 }
 
+// SetLocal binds a variable to a register.
+func (g *generator) SetLocal(name string, reg register) {
+	g.Locals[name] = reg
+	g.Names[reg] = name
+}
+
 func (g generator) ResolveRegister(r register) register {
 	for {
 		r2, ok := g.Substitutions[r]
@@ -79,7 +119,11 @@ func (g generator) ResolveRegister(r register) register {
 }
 
 func (g generator) Reg(r register) string {
-	return fmt.Sprintf("sp->r[%d]", g.ResolveRegister(r))
+	r = g.ResolveRegister(r)
+	if g.slots != nil {
+		return fmt.Sprintf("sp->r[%d]", g.slots[r])
+	}
+	return fmt.Sprintf("sp->r[%d]", r)
 }
 
 func (g *generator) JoinRegisters(a, b register) {
@@ -100,7 +144,7 @@ func (g *generator) Stmt(s generatedStatement) {
 }
 
 func (g *generator) StmtWithCond(c condition, s generatedStatement) {
-	g.Conditions = append(g.Conditions, stmtWithCondition{c, s})
+	g.Conditions = append(g.Conditions, stmtWithCondition{c, s, g.Pos})
 }
 
 func (g *generator) NewReg(k *Kind, immediate bool) register {
@@ -109,6 +153,15 @@ func (g *generator) NewReg(k *Kind, immediate bool) register {
 	return reg
 }
 
+func (g *generator) IsLocal(reg register) bool {
+	for _, local := range g.Locals {
+		if g.ResolveRegister(local) == g.ResolveRegister(reg) {
+			return true
+		}
+	}
+	return false
+}
+
 func (g *generator) CopyOfLocals() map[string]register {
 	result := map[string]register{}
 	for name, reg := range g.Locals {
@@ -129,6 +182,8 @@ func (g *generator) GarbageRegisters(keep []register) (map[register]*Kind, error
 		if kind != nil && !keepMap[reg] && kind.NeedsToBeDeleted() {
 			if kind.CanBeImplicitlyDeleted() {
 				garbage[reg] = kind
+			} else if kind.Linear {
+				return nil, fmt.Errorf("linear value of type %s must be consumed (r%d)", kind, reg)
 			} else {
 				return nil, fmt.Errorf("unused value of type %s (r%d)", kind, reg)
 			}
@@ -137,16 +192,47 @@ func (g *generator) GarbageRegisters(keep []register) (map[register]*Kind, error
 	return garbage, nil
 }
 
+// releasedRegisters lists the registers that a return hands back to the
+// caller or frees, in a stable order.
+func releasedRegisters(values []register, garbage map[register]*Kind) []register {
+	result := append([]register{}, values...)
+	for reg := range garbage {
+		result = append(result, reg)
+	}
+	sort.Slice(result[len(values):], func(i, j int) bool {
+		return result[len(values)+i] < result[len(values)+j]
+	})
+	return result
+}
+
 func (g generator) TypeDefinition(w io.Writer) {
 	if g.IsNative {
 		fmt.Fprintf(w, "void unique_effect_%s();\n", g.Name)
 		return
 	}
 	fmt.Fprintf(w, "struct unique_effect_%s_state {\n", g.Name)
-	fmt.Fprintf(w, "  future_t r[%d];\n", len(g.Registers))
-	fmt.Fprintf(w, "  future_t *result[%d];\n", g.Results)
+	g.formatSlotComments(w)
+	fmt.Fprintf(w, "  future_t r[%d];\n", g.FrameSize())
+	if g.Consumed > 0 {
+		fmt.Fprintf(w, "  bool consumed[%d];\n", g.Consumed)
+	}
+	if g.Results > 0 {
+		fmt.Fprintf(w, "  future_t *result[%d];\n", g.Results)
+	} else {
+		fmt.Fprintf(w, "  future_t *result[1]; // unused\n")
+	}
 	fmt.Fprintf(w, "  closure_t caller;\n")
-	fmt.Fprintf(w, "  bool conditions[%d];\n", len(g.Conditions))
+	fmt.Fprintf(w, "#ifdef UNIQUE_EFFECT_TRACE\n")
+	fmt.Fprintf(w, "  const char *position; // of the call\n")
+	fmt.Fprintf(w, "#endif\n")
+	fmt.Fprintf(w, "  bool conditions[%d];\n", g.NextCondition+1)
+	fmt.Fprintf(w, "  bool pending[%d];\n", atLeastOne(len(g.Conditions)))
+	fmt.Fprintf(w, "  int worklist[%d];\n", atLeastOne(len(g.Conditions)))
+	fmt.Fprintf(w, "  int worklist_size;\n")
+	fmt.Fprintf(w, "  bool seen[%d];\n", atLeastOne(len(g.wakeups().External)))
+	fmt.Fprintf(w, "  bool cancelling;\n")
+	fmt.Fprintf(w, "  int inflight[%d];\n", atLeastOne(len(g.ChildCalls)))
+	fmt.Fprintf(w, "  int inflight_size;\n")
 	for index, kind := range g.ChildCalls {
 		fmt.Fprintf(w, "  struct unique_effect_%s_state *call_%d;\n", kind, index)
 		fmt.Fprintf(w, "  bool call_%d_done;\n", index)
@@ -155,6 +241,36 @@ func (g generator) TypeDefinition(w io.Writer) {
 	fmt.Fprintf(w, "%s;\n", g.Header())
 }
 
+// formatSlotComments lists the registers that each slot in sp->r holds, along
+// with the variables they were bound to.
+func (g *generator) formatSlotComments(w io.Writer) {
+	holders := make([][]string, g.FrameSize())
+	for i, kind := range g.Registers {
+		reg := register(i)
+		if i < len(g.ArgKinds) {
+			kind = g.ArgKinds[i]
+		}
+		slot, ok := g.slots[reg]
+		if g.slots == nil {
+			slot, ok = i, g.ResolveRegister(reg) == reg
+		}
+		if !ok {
+			continue
+		}
+		name := fmt.Sprintf("r%d", i)
+		if local, ok := g.Names[reg]; ok {
+			name += fmt.Sprintf(" (%s)", local)
+		}
+		if kind != nil {
+			name += fmt.Sprintf(": %s", kind)
+		}
+		holders[slot] = append(holders[slot], name)
+	}
+	for slot, registers := range holders {
+		fmt.Fprintf(w, "  // r[%d]: %s\n", slot, strings.Join(registers, ", then "))
+	}
+}
+
 func (g *generator) DumpRegisters(w io.Writer) {
 	fmt.Fprintf(w, "  fprintf(stderr, \"%15s %%p ready=", g.Name)
 	for range g.Conditions {
@@ -171,39 +287,201 @@ func (g *generator) DumpRegisters(w io.Writer) {
 
 	for i := range g.Registers {
 		localName := ""
-		for lcl, reg := range g.Locals {
-			if reg == register(i) {
-				localName = "(" + lcl + ")"
-			}
+		if lcl, ok := g.Names[register(i)]; ok {
+			localName = "(" + lcl + ")"
 		}
-		fmt.Fprintf(w, ", (%s.ready ? \"r%d%s \" : \"\")", g.Reg(register(i)), i, localName)
+		fmt.Fprintf(w, ", (%s ? \"r%d%s \" : \"\")", g.Ready(register(i)), i, localName)
 	}
 	fmt.Fprintf(w, ");\n")
 }
 
-func (g *generator) FormatInto(w io.Writer) {
+// wakeups describes which statements to check when something changes, so
+// that each call to a function only checks the statements that could run.
+type wakeups struct {
+	// Registers and conditions, and the statements that wait on them.
+	Registers  map[register][]int
+	Conditions map[condition][]int
+	// External registers are filled in by other functions.
+	External []register
+	// Calls to other functions, which are polled while they're in flight.
+	Calls map[childCall]*genCallAsyncFunction
+	// Returns wait for the last call in flight to return.
+	Returns []int
+}
+
+func (g *generator) wakeups() wakeups {
+	result := wakeups{
+		Registers:  map[register][]int{},
+		Conditions: map[condition][]int{},
+		Calls:      map[childCall]*genCallAsyncFunction{},
+	}
+	external := map[register]bool{}
+	for i := range g.ArgKinds {
+		external[g.ResolveRegister(register(i))] = true
+	}
+
+	for i, stmtWithCondition := range g.Conditions {
+		stmt := stmtWithCondition.Statement
+		needs, _ := stmt.Deps()
+		conditions := []condition{stmtWithCondition.Cond}
+		if guarded, ok := stmt.(statementWithGuards); ok {
+			registers, skipped := guarded.GuardDeps()
+			needs = append(append([]register{}, needs...), registers...)
+			conditions = append(conditions, skipped...)
+		}
+
+		switch call := unwrapStatement(stmt).(type) {
+		case *genCallAsyncFunction:
+			needs = append(needs, call.Args...)
+			for _, result := range call.Result {
+				external[g.ResolveRegister(result)] = true
+			}
+			result.Calls[call.ChildCall] = call
+		case *genRestartLoop:
+			needs = append(needs, call.Args...)
+		case *genReturn:
+			result.Returns = append(result.Returns, i)
+		}
+
+		// A register can be both a dependency and a guard, but the statement
+		// only needs waking once.
+		for _, need := range needs {
+			need = g.ResolveRegister(need)
+			if waiting := result.Registers[need]; len(waiting) == 0 || waiting[len(waiting)-1] != i {
+				result.Registers[need] = append(waiting, i)
+			}
+		}
+		for _, c := range conditions {
+			if waiting := result.Conditions[c]; len(waiting) == 0 || waiting[len(waiting)-1] != i {
+				result.Conditions[c] = append(waiting, i)
+			}
+		}
+	}
+
+	for reg := range external {
+		result.External = append(result.External, reg)
+	}
+	sort.Slice(result.External, func(i, j int) bool {
+		return result.External[i] < result.External[j]
+	})
+	return result
+}
+
+// loops reports whether the function restarts itself, as the body of a loop.
+func (g *generator) loops() bool {
+	for _, stmt := range g.Conditions {
+		if _, ok := unwrapStatement(stmt.Statement).(*genRestartLoop); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// unwrapStatement returns the statement that a genAfter delays.
+func unwrapStatement(stmt generatedStatement) generatedStatement {
+	if after, ok := stmt.(*genAfter); ok {
+		return after.Statement
+	}
+	return stmt
+}
+
+// atLeastOne sizes arrays in C, which can't be empty.
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+func formatWakeAll(w io.Writer, statements []int, indent string) {
+	for _, i := range statements {
+		fmt.Fprintf(w, "%sunique_effect_wake(sp->worklist, &sp->worklist_size, sp->pending, %d);\n", indent, i)
+	}
+}
+
+// FormatInto writes the C code for the function. Statements are attributed to
+// the .ht files in sourceDir.
+func (g *generator) FormatInto(w io.Writer, sourceDir string) {
 	if g.IsNative {
 		return
 	}
 
+	wakeups := g.wakeups()
+
 	fmt.Fprintf(w, "%s {\n", g.Header())
+	if g.loops() {
+		// Loops that reuse the state start over from here.
+		fmt.Fprintf(w, "start:\n")
+	}
+	fmt.Fprintf(w, "  UNIQUE_EFFECT_STAT(wakeups, 1);\n")
+	fmt.Fprintf(w, "  UNIQUE_EFFECT_STAT(full_scan, %d);\n", len(g.Conditions))
+	fmt.Fprintf(w, "  %s", g.Trace('B', "false"))
 
 	fmt.Fprintf(w, "  if (!sp->conditions[0]) {\n")
+	fmt.Fprintf(w, "    %s", g.Trace('b', "false"))
 	fmt.Fprintf(w, "    memset(&sp->conditions, '\\0', sizeof(sp->conditions));\n")
 	fmt.Fprintf(w, "    sp->conditions[0] = true;\n")
 	for i := range g.ChildCalls {
 		fmt.Fprintf(w, "    sp->call_%d = NULL;\n", i)
 		fmt.Fprintf(w, "    sp->call_%d_done = false;\n", i)
 	}
+	fmt.Fprintf(w, "    memset(&sp->pending, '\\0', sizeof(sp->pending));\n")
+	fmt.Fprintf(w, "    memset(&sp->seen, '\\0', sizeof(sp->seen));\n")
+	if g.Consumed > 0 {
+		fmt.Fprintf(w, "    memset(&sp->consumed, '\\0', sizeof(sp->consumed));\n")
+	}
+	fmt.Fprintf(w, "    sp->worklist_size = 0;\n")
+	fmt.Fprintf(w, "    sp->cancelling = false;\n")
+	fmt.Fprintf(w, "    sp->inflight_size = 0;\n")
+	fmt.Fprintf(w, "    for (int i = 0; i < %d; i++) {\n", len(g.Conditions))
+	fmt.Fprintf(w, "      unique_effect_wake(sp->worklist, &sp->worklist_size, sp->pending, i);\n")
+	fmt.Fprintf(w, "    }\n")
 	fmt.Fprintf(w, "  }\n")
 
 	// g.DumpRegisters(w)
 
-	for _, stmtWithCondition := range g.Conditions {
+	// Values from other functions may have arrived since the last call.
+	for i, reg := range wakeups.External {
+		fmt.Fprintf(w, "  if (%s && !sp->seen[%d]) {\n", g.Ready(reg), i)
+		fmt.Fprintf(w, "    sp->seen[%d] = true;\n", i)
+		formatWakeAll(w, wakeups.Registers[reg], "    ")
+		fmt.Fprintf(w, "  }\n")
+		fmt.Fprintf(w, "  sp->cancelling |= %s.cancelled;\n", g.Reg(reg))
+	}
+	if len(wakeups.Calls) > 0 {
+		fmt.Fprintf(w, "  for (int i = 0; i < sp->inflight_size; i++) {\n")
+		fmt.Fprintf(w, "    switch (sp->inflight[i]) {\n")
+		for id := range g.ChildCalls {
+			call, ok := wakeups.Calls[childCall(id)]
+			if !ok || len(call.Result) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "    case %d:\n", id)
+			fmt.Fprintf(w, "      if (%s) {\n", g.Ready(call.Result[0]))
+			fmt.Fprintf(w, "        // The call has returned, and its state is gone.\n")
+			fmt.Fprintf(w, "        sp->inflight[i--] = sp->inflight[--sp->inflight_size];\n")
+			if len(wakeups.Returns) > 0 {
+				fmt.Fprintf(w, "        if (sp->inflight_size == 0) {\n")
+				formatWakeAll(w, wakeups.Returns, "          ")
+				fmt.Fprintf(w, "        }\n")
+			}
+			fmt.Fprintf(w, "        break;\n")
+			fmt.Fprintf(w, "      }\n")
+			call.generatePoll(g, w)
+			fmt.Fprintf(w, "      break;\n")
+		}
+		fmt.Fprintf(w, "    }\n")
+		fmt.Fprintf(w, "  }\n")
+	}
+
+	fmt.Fprintf(w, "  while (sp->worklist_size > 0) {\n")
+	fmt.Fprintf(w, "    UNIQUE_EFFECT_STAT(statements_checked, 1);\n")
+	fmt.Fprintf(w, "    switch (unique_effect_next_statement(sp->worklist, &sp->worklist_size, sp->pending)) {\n")
+	for i, stmtWithCondition := range g.Conditions {
 		condition := stmtWithCondition.Cond
 		stmt := stmtWithCondition.Statement
 
-		fmt.Fprintf(w, "  // %#v\n", stmt)
+		fmt.Fprintf(w, "  case %d: // %s\n", i, formatStatement(stmt))
 
 		if condition > 0 {
 			fmt.Fprintf(w, "  if (sp->conditions[%d]", condition)
@@ -213,18 +491,45 @@ func (g *generator) FormatInto(w io.Writer) {
 
 		needs, provides := stmt.Deps()
 		for _, need := range needs {
-			fmt.Fprintf(w, " && %s.ready", g.Reg(need))
+			fmt.Fprintf(w, " && %s", g.Ready(need))
 		}
 		for _, provide := range provides {
-			fmt.Fprintf(w, " && !%s.ready", g.Reg(provide))
+			fmt.Fprintf(w, " && %s", g.NotReady(provide))
+		}
+		if guarded, ok := stmt.(statementWithGuards); ok {
+			for _, guard := range guarded.Guards(g) {
+				fmt.Fprintf(w, " && %s", guard)
+			}
 		}
 		fmt.Fprintf(w, ") {\n")
 
-		fmt.Fprintf(w, "%s", stmt.Generate(g))
+		if _, ok := unwrapStatement(stmt).(*genCallSyncFunction); ok && stmtWithCondition.Pos.Line > 0 {
+			fmt.Fprintf(w, "    UNIQUE_EFFECT_TRACE_AT(%q);\n", stmtWithCondition.Pos.String())
+		}
+		formatAtSource(stmt.Generate(g), stmtWithCondition.Pos, sourceDir, w)
+		g.formatConsume(stmt, w)
+
+		// Wake up whatever was waiting on this statement. Calls to other
+		// functions finish later, as external registers.
+		if _, ok := unwrapStatement(stmt).(*genCallAsyncFunction); ok {
+			provides = nil
+		}
+		for _, provide := range provides {
+			formatWakeAll(w, wakeups.Registers[g.ResolveRegister(provide)], "    ")
+		}
+		if branch, ok := stmt.(*genBranch); ok {
+			formatWakeAll(w, wakeups.Conditions[branch.IfTrue], "    ")
+			formatWakeAll(w, wakeups.Conditions[branch.IfFalse], "    ")
+		}
 		fmt.Fprintf(w, "  }\n")
+		fmt.Fprintf(w, "  break;\n")
 	}
+	fmt.Fprintf(w, "    }\n")
+	fmt.Fprintf(w, "  }\n")
 
-	// Iterate in reverse order, propagate the cancellation status.
+	// Iterate in reverse order, propagate the cancellation status. Nothing
+	// is cancelled until a call to another function reports it.
+	fmt.Fprintf(w, "  if (sp->cancelling) {\n")
 	for i := len(g.Conditions) - 1; i >= 0; i -= 1 {
 		stmt := g.Conditions[i].Statement
 
@@ -235,24 +540,36 @@ func (g *generator) FormatInto(w io.Writer) {
 
 		fmt.Fprintf(w, "  if (true")
 		for _, provide := range provides {
-			fmt.Fprintf(w, " && %[1]s.cancelled && !%[1]s.ready", g.Reg(provide))
+			fmt.Fprintf(w, " && %s.cancelled && %s", g.Reg(provide), g.NotReady(provide))
 		}
 		fmt.Fprintf(w, ") {\n")
 		if cancel, ok := stmt.(statementWithCancel); ok {
 			cancel.GenerateCancel(g, w)
 		} else {
 			for _, need := range needs {
-				fmt.Fprintf(w, "    %s.cancelled = true;\n", g.Reg(need))
+				g.Cancel(need, "    ", w)
 			}
 		}
 		fmt.Fprintf(w, "  }\n")
 	}
+	fmt.Fprintf(w, "  }\n")
 
 	// g.DumpRegisters(w)
 
+	fmt.Fprintf(w, "  %s", g.Trace('E', "sp->cancelling"))
 	fmt.Fprintf(w, "}\n")
 }
 
+// Trace is the C code for an event in the trace of this function's calls
+// (see unique_effect_trace), where cancelled is a C expression.
+func (g *generator) Trace(phase byte, cancelled string) string {
+	position := ""
+	if g.Pos.Line > 0 {
+		position = g.Pos.String()
+	}
+	return fmt.Sprintf("UNIQUE_EFFECT_TRACE_EVENT('%c', %q, %q, %s);\n", phase, g.Name, position, cancelled)
+}
+
 func (g *generator) FormatMainInto(w io.Writer) error {
 	fmt.Fprintf(w, "int main(int argc, const char* argv[]) {\n")
 	fmt.Fprintf(w, "  struct unique_effect_runtime rt;\n")
@@ -290,33 +607,134 @@ func (g generator) Header() string {
 
 func (g *generator) NewClosure(p *program, argNames []string, argKinds []*Kind, results []*Kind) *generator {
 	g.NextClosure += 1
-	return newGenerator(fmt.Sprintf("%s_%d", g.Name, g.NextClosure), p, argNames, argKinds, results)
+	closure := newGenerator(fmt.Sprintf("%s_%d", g.Name, g.NextClosure), p, argNames, argKinds, results)
+	closure.IsClosure = true
+	closure.Pos = g.Pos
+	return closure
 }
 
 func (g *generator) NewCondition() condition {
 	g.NextCondition += 1
+	g.ConditionParents[g.NextCondition] = g.CurrentCondition
 	return g.NextCondition
 }
 
+// NewBranch returns two new conditions, at most one of which will ever hold.
+func (g *generator) NewBranch() (condition, condition) {
+	a, b := g.NewCondition(), g.NewCondition()
+	g.ConditionSiblings[a] = b
+	g.ConditionSiblings[b] = a
+	return a, b
+}
+
+// conditionImplies is true if inner can only hold when outer does, that is,
+// if inner is outer or nested within it.
+func (g *generator) conditionImplies(inner, outer condition) bool {
+	for inner != outer && inner != 0 {
+		inner = g.ConditionParents[inner]
+	}
+	return inner == outer
+}
+
 func (g *generator) NewChildCall(name string) childCall {
 	g.ChildCalls = append(g.ChildCalls, name)
 	return childCall(len(g.ChildCalls) - 1)
 }
 
-func (g *generator) MaybeMakeTuple(registers []register) register {
+func (g *generator) MaybeMakeTuple(registers []register, position *lexer.Position) (register, error) {
 	if len(registers) == 1 {
-		return registers[0]
+		return registers[0], nil
 	} else {
 		types := []*Kind{}
 		for _, reg := range registers {
 			types = append(types, g.Registers[reg])
 		}
-		result := g.NewReg(&Kind{false, FamilyTuple, types, "Tuple"}, true)
+		result := g.NewReg(&Kind{Family: FamilyTuple, TupleOrUnionArgs: types, Label: "Tuple"}, true)
 		g.Stmt(&genMakeTuple{Inputs: registers, Result: result})
-		return result
+		for _, reg := range registers {
+			g.Consume(reg, position)
+		}
+		return result, g.EndBorrows(registers...)
 	}
 }
 
+// Borrow records that the statement just emitted reads reg without consuming
+// it. Statements run as soon as their inputs are ready, so whatever consumes
+// reg later has to wait until this one is done with it.
+func (g *generator) Borrow(reg register) {
+	reg = g.ResolveRegister(reg)
+	g.Borrowers[reg] = append(g.Borrowers[reg], len(g.Conditions)-1)
+}
+
+// AddView records that view borrows from inside reg, so that borrowing view
+// counts as borrowing reg.
+func (g *generator) AddView(reg, view register) {
+	reg = g.ResolveRegister(reg)
+	g.Views[reg] = append(g.Views[reg], view)
+}
+
+// EndBorrows makes the statement just emitted, which consumes (or frees) the
+// given registers, wait until every statement still borrowing them is done.
+// Borrows that can't be waited for are rejected.
+func (g *generator) EndBorrows(regs ...register) error {
+	consumer := len(g.Conditions) - 1
+	waits := []borrowWait{}
+	for i := 0; i < len(regs); i++ {
+		reg := g.ResolveRegister(regs[i])
+		regs = append(regs, g.Views[reg]...)
+		for _, borrower := range g.Borrowers[reg] {
+			if borrower >= consumer {
+				continue
+			}
+			wait, err := g.waitForBorrower(borrower, consumer, reg)
+			if err != nil {
+				return err
+			}
+			waits = append(waits, wait...)
+		}
+	}
+	if len(waits) == 0 {
+		return nil
+	}
+
+	stmt := &g.Conditions[consumer]
+	if delayed, ok := stmt.Statement.(*genAfter); ok {
+		delayed.Waits = append(delayed.Waits, waits...)
+	} else {
+		stmt.Statement = &genAfter{stmt.Statement, waits}
+	}
+	return nil
+}
+
+func (g *generator) waitForBorrower(borrower, consumer int, reg register) ([]borrowWait, error) {
+	borrowerCond, consumerCond := g.Conditions[borrower].Cond, g.Conditions[consumer].Cond
+	if !g.conditionImplies(consumerCond, borrowerCond) && !g.conditionImplies(borrowerCond, consumerCond) {
+		// The two never run together.
+		return nil, nil
+	}
+
+	_, provides := g.Conditions[borrower].Statement.Deps()
+	if len(provides) == 0 {
+		return nil, fmt.Errorf("value of type %s (r%d) is borrowed by a call that returns nothing, so it can't be consumed or freed safely", g.Registers[reg], reg)
+	}
+
+	// If the borrower is in a branch that the consumer comes after, the
+	// borrower might never run: then it is enough for another branch to be
+	// taken instead.
+	skipped := []condition{}
+	for c := borrowerCond; c != consumerCond && c != 0; c = g.ConditionParents[c] {
+		if sibling, ok := g.ConditionSiblings[c]; ok {
+			skipped = append(skipped, sibling)
+		}
+	}
+
+	waits := []borrowWait{}
+	for _, provide := range provides {
+		waits = append(waits, borrowWait{provide, skipped})
+	}
+	return waits, nil
+}
+
 func (g *generator) Consume(reg register, position *lexer.Position) {
 	for idx := range g.Registers {
 		if r := register(idx); g.ResolveRegister(r) == reg {
@@ -331,3 +749,23 @@ func (g *generator) Consume(reg register, position *lexer.Position) {
 		}
 	}
 }
+
+// ConvertTo checks that reg can be used as the given kind, wrapping it into a
+// tagged union first if target is a union with a matching option.
+func (g *generator) ConvertTo(reg register, target *Kind, position *lexer.Position) (register, error) {
+	kind := g.Registers[reg]
+	err := kind.CanConvertTo(*target)
+	if err == nil || target.Family != FamilyUnion || kind.Family == FamilyUnion {
+		return reg, err
+	}
+
+	for i, option := range target.UnpackAsUnion() {
+		if kind.CanConvertTo(*option) == nil {
+			result := g.NewReg(target, true)
+			g.Stmt(&genMakeUnion{reg, i, result})
+			g.Consume(reg, position)
+			return result, g.EndBorrows(reg)
+		}
+	}
+	return reg, err
+}
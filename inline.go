@@ -0,0 +1,306 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+// Calling a function allocates its state and goes through the scheduler, even
+// when the function never waits on anything. InlineFunctions copies the
+// statements of such functions into their callers instead.
+//
+// A function can be inlined when it is sync: it makes no calls to other
+// functions (besides sync natives) and doesn't loop. Its statements then
+// only wait on each other, so they behave the same way in the caller. The
+// return statement still waits for all of the results, so a function like
+// barrier in barriers.ht still orders the values passed through it.
+//
+// Once a function returns, its state is freed and nothing else in it runs.
+// Functions whose statements could still run after the return are not
+// inlined, since they would then run in the caller.
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// inlineLimit is the most statements a function can have and be inlined.
+const inlineLimit = 64
+
+// genInlineReturn hands the results of an inlined function to its caller, and
+// frees whatever the function didn't consume.
+type genInlineReturn struct {
+	ReturnValue []register
+	Result      []register
+	Garbage     map[register]*Kind
+}
+
+func (g *genInlineReturn) Generate(gen *generator) string {
+	b := strings.Builder{}
+	for i, reg := range g.ReturnValue {
+		fmt.Fprintf(&b, "    %s = %s;\n", gen.Reg(g.Result[i]), gen.Reg(reg))
+	}
+	freeGarbage(gen, g.Garbage, &b)
+	return b.String()
+}
+
+func (g *genInlineReturn) Deps() ([]register, []register) {
+	return g.ReturnValue, g.Result
+}
+
+// InlineFunctions inlines calls to sync functions, until there are none left.
+// A function whose calls have all been inlined may become sync itself.
+func (p *program) InlineFunctions() {
+	sorted := append([]*generator{}, p.GeneratedFunctions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	byName := map[string]*generator{}
+	for _, g := range sorted {
+		byName[g.Name] = g
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, g := range sorted {
+			if g.IsNative {
+				continue
+			}
+			for i := 0; i < len(g.Conditions); i++ {
+				call, ok := g.Conditions[i].Statement.(*genCallAsyncFunction)
+				if !ok {
+					continue
+				}
+				callee := byName[call.Name]
+				if callee == nil || callee == g || !callee.CanBeInlined() {
+					continue
+				}
+				g.Inline(i, callee)
+				changed = true
+			}
+			g.removeUnusedChildCalls()
+		}
+	}
+}
+
+// CanBeInlined reports whether a function is sync, small, and has nothing
+// left to do once it returns.
+func (g *generator) CanBeInlined() bool {
+	if g.IsNative || g.IsDestructor || g.Name == "main" || len(g.Conditions) > inlineLimit {
+		return false
+	}
+
+	returns := -1
+	for i, stmt := range g.Conditions {
+		switch unwrapStatement(stmt.Statement).(type) {
+		case *genCallAsyncFunction, *genRestartLoop:
+			return false
+		case *genReturn:
+			if returns >= 0 || stmt.Cond != 0 {
+				return false
+			}
+			returns = i
+		}
+	}
+	if returns < 0 {
+		return false
+	}
+
+	// Everything has to happen before the return: its values, and whatever
+	// it waits on, depend on every other statement.
+	providers := map[register][]int{}
+	branches := map[condition][]int{}
+	for i, stmt := range g.Conditions {
+		_, provides := stmt.Statement.Deps()
+		for _, reg := range provides {
+			reg = g.ResolveRegister(reg)
+			providers[reg] = append(providers[reg], i)
+		}
+		if branch, ok := stmt.Statement.(*genBranch); ok {
+			branches[branch.IfTrue] = append(branches[branch.IfTrue], i)
+			branches[branch.IfFalse] = append(branches[branch.IfFalse], i)
+		}
+	}
+	before := map[int]bool{}
+	var visit func(i int)
+	visit = func(i int) {
+		if before[i] {
+			return
+		}
+		before[i] = true
+		stmt := g.Conditions[i]
+		needs, _ := stmt.Statement.Deps()
+		if guarded, ok := stmt.Statement.(statementWithGuards); ok {
+			registers, _ := guarded.GuardDeps()
+			needs = append(append([]register{}, needs...), registers...)
+		}
+		for _, need := range needs {
+			for _, j := range providers[g.ResolveRegister(need)] {
+				visit(j)
+			}
+		}
+		// Statements in a branch run after the branch is taken.
+		for c := stmt.Cond; c != 0; c = g.ConditionParents[c] {
+			for _, j := range branches[c] {
+				visit(j)
+			}
+		}
+	}
+	visit(returns)
+
+	for i, stmt := range g.Conditions {
+		if _, ok := stmt.Statement.(*genComment); !ok && !before[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Inline replaces the call at g.Conditions[index] with the body of callee.
+func (g *generator) Inline(index int, callee *generator) {
+	call := g.Conditions[index].Statement.(*genCallAsyncFunction)
+	at := g.Conditions[index].Cond
+
+	// Arguments are read straight from the caller's registers, and every
+	// other register gets a new one.
+	registers := map[register]register{}
+	for i := range callee.Registers {
+		reg := callee.ResolveRegister(register(i))
+		if int(reg) < len(callee.ArgKinds) {
+			registers[register(i)] = call.Args[reg]
+		} else if _, ok := registers[reg]; !ok {
+			registers[reg] = g.NewReg(callee.Registers[reg], false)
+		}
+	}
+	for i := range callee.Registers {
+		registers[register(i)] = registers[callee.ResolveRegister(register(i))]
+	}
+	for i := range callee.Registers {
+		name, ok := callee.Names[register(i)]
+		if _, named := g.Names[registers[register(i)]]; ok && !named {
+			g.Names[registers[register(i)]] = name
+		}
+	}
+
+	conditions := map[condition]condition{0: at}
+	for c := condition(1); c <= callee.NextCondition; c++ {
+		g.NextCondition++
+		conditions[c] = g.NextCondition
+	}
+	for c := condition(1); c <= callee.NextCondition; c++ {
+		g.ConditionParents[conditions[c]] = conditions[callee.ConditionParents[c]]
+		if sibling, ok := callee.ConditionSiblings[c]; ok {
+			g.ConditionSiblings[conditions[c]] = conditions[sibling]
+		}
+	}
+
+	body := []stmtWithCondition{}
+	for _, stmt := range callee.Conditions {
+		copied := copyStatement(stmt.Statement, registers, conditions)
+		if after, ok := copied.(*genAfter); ok {
+			if ret, ok := after.Statement.(*genReturn); ok {
+				after.Statement = inlineReturn(ret, call.Result)
+			}
+		} else if ret, ok := copied.(*genReturn); ok {
+			copied = inlineReturn(ret, call.Result)
+		}
+		body = append(body, stmtWithCondition{conditions[stmt.Cond], copied, stmt.Pos})
+	}
+
+	rest := append([]stmtWithCondition{}, g.Conditions[index+1:]...)
+	g.Conditions = append(append(g.Conditions[:index], body...), rest...)
+}
+
+func inlineReturn(ret *genReturn, results []register) *genInlineReturn {
+	return &genInlineReturn{
+		ReturnValue: ret.ReturnValue,
+		Result:      results,
+		Garbage:     ret.Garbage,
+	}
+}
+
+// copyStatement makes a copy of a statement from another function, with its
+// registers and conditions renamed.
+func copyStatement(stmt generatedStatement, registers map[register]register, conditions map[condition]condition) generatedStatement {
+	var copyValue func(v reflect.Value) reflect.Value
+	copyValue = func(v reflect.Value) reflect.Value {
+		switch v.Type() {
+		case registerType:
+			return reflect.ValueOf(registers[register(v.Int())])
+		case conditionType:
+			return reflect.ValueOf(conditions[condition(v.Int())])
+		case kindType:
+			return v
+		}
+
+		result := reflect.New(v.Type()).Elem()
+		switch v.Kind() {
+		case reflect.Interface:
+			if !v.IsNil() {
+				result.Set(copyValue(v.Elem()))
+			}
+		case reflect.Ptr:
+			if !v.IsNil() {
+				inner := reflect.New(v.Type().Elem())
+				inner.Elem().Set(copyValue(v.Elem()))
+				result.Set(inner)
+			}
+		case reflect.Slice:
+			if !v.IsNil() {
+				result.Set(reflect.MakeSlice(v.Type(), v.Len(), v.Len()))
+				for i := 0; i < v.Len(); i++ {
+					result.Index(i).Set(copyValue(v.Index(i)))
+				}
+			}
+		case reflect.Map:
+			if !v.IsNil() {
+				result.Set(reflect.MakeMap(v.Type()))
+				for _, key := range v.MapKeys() {
+					result.SetMapIndex(copyValue(key), copyValue(v.MapIndex(key)))
+				}
+			}
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				result.Field(i).Set(copyValue(v.Field(i)))
+			}
+		default:
+			result.Set(v)
+		}
+		return result
+	}
+	return copyValue(reflect.ValueOf(&stmt).Elem()).Interface().(generatedStatement)
+}
+
+// removeUnusedChildCalls renumbers the calls to other functions that are left.
+func (g *generator) removeUnusedChildCalls() {
+	ids := map[childCall]childCall{}
+	calls := []string{}
+	for _, stmt := range g.Conditions {
+		var id *childCall
+		switch s := unwrapStatement(stmt.Statement).(type) {
+		case *genCallAsyncFunction:
+			id = &s.ChildCall
+		case *genRestartLoop:
+			id = &s.ChildCall
+		default:
+			continue
+		}
+		if _, ok := ids[*id]; !ok {
+			ids[*id] = childCall(len(calls))
+			calls = append(calls, g.ChildCalls[*id])
+		}
+		*id = ids[*id]
+	}
+	g.ChildCalls = calls
+}
@@ -0,0 +1,818 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+// The intermediate representation (IR) is the list of generated functions,
+// each one a set of registers and the statements that fill them in. It is
+// what the C backend (FormatInto) works from. Its text format looks like:
+//
+//	func greet(r0 (stdout): Stream, r1 (name): &String) (Stream) at hello.ht:3:1 {
+//	  r2: String
+//	  r3 (stdout): Stream
+//	  r4 = r3
+//	  c1 in c0 else c2
+//	  call0: sleep
+//	  packed
+//	  share r2, r5
+//	  c0: string "Hello, " -> r2 at hello.ht:4:2 // -> r2
+//	  c0: call "print" [r0, r2] -> [r3] at hello.ht:4:2 // r0 r2 -> r3
+//	}
+//
+// The header lists the arguments (the first registers) and the result kinds,
+// followed by where the function was declared, if anywhere. It may be
+// prefixed with "native", "closure" or "destructor". In the body:
+//
+//   - "r2: String" declares a register and its Kind, or "_" if it has none.
+//     A register that holds a variable is followed by its name, as in
+//     "r3 (stdout): Stream";
+//   - "r4 = r3" means that r4 was merged into r3;
+//   - "c1 in c0 else c2" declares a condition that only holds within c0, and
+//     never at the same time as c2;
+//   - "call0: sleep" declares the state used to call another function;
+//   - "packed" means that each register has been given a slot in the
+//     function's state, leaving out those that are never used, and "share
+//     r2, r5" lists registers that take turns using one slot (see
+//     liveness.go);
+//   - "c0: string ..." is a statement that runs once c0 holds and its inputs
+//     are ready, written as irOps below says. It may be followed by
+//     "at file:line:column", the source statement it was generated for. The
+//     comment after a statement shows what it needs and provides.
+//
+// Kinds are written as in the source language, and resolved against the
+// program's types when the IR is parsed back. Lines starting with "#" are
+// comments; -emit-ir uses them to separate the IR after each pass.
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// irOps gives the syntax of every kind of statement. Each starts with the
+// name of the statement, and each "%operand" in it is one of the values that
+// irOperands lists, in the same order. How an operand is written depends on
+// its type:
+//
+//   - registers as "r3", conditions as "c1", and calls as "call0";
+//   - kinds as in the source language, or "_";
+//   - strings quoted as in Go, and numbers and booleans as in Go;
+//   - lists of registers as "[r1, r2]";
+//   - garbage (values freed on the way out) as "{r1: String, r4: Point}";
+//   - borrows to wait for as "[r3, r5 unless [c1, c2]]", where the borrow
+//     of r5 is over once r5 is ready, or once c1 or c2 holds;
+//   - statements (only in "after") in their own syntax.
+var irOps = []struct {
+	syntax string
+	new    func() generatedStatement
+}{
+	{"after %statement waiting for %borrows", func() generatedStatement { return &genAfter{} }},
+	{"arithmetic %left %op %right: %kind -> %result from %position", func() generatedStatement { return &genArithmetic{} }},
+	{"array %values -> %result", func() generatedStatement { return &genNewArray{} }},
+	{"box %input -> %result", func() generatedStatement { return &genMakeBox{} }},
+	{"branch %condition then %if_true else %if_false", func() generatedStatement { return &genBranch{} }},
+	{"call %name %args -> %results", func() generatedStatement { return &genCallSyncFunction{} }},
+	{"call_async %name %args -> %results using %call from %position", func() generatedStatement { return &genCallAsyncFunction{} }},
+	{"comment %message", func() generatedStatement { return &genComment{} }},
+	{"compare %left %op %right: %kind -> %result", func() generatedStatement { return &genNumericComparison{} }},
+	{"drop %input: %kind -> %done", func() generatedStatement { return &genDrop{} }},
+	{"extract %input borrowed %borrowed -> %result", func() generatedStatement { return &genExtractUnionValue{} }},
+	{"float %value -> %result", func() generatedStatement { return &genFloatLiteral{} }},
+	{"inline_return %values garbage %garbage -> %results", func() generatedStatement { return &genInlineReturn{} }},
+	{"integer %value -> %result", func() generatedStatement { return &genIntegerLiteral{} }},
+	{"is %input variant %index -> %result", func() generatedStatement { return &genCheckUnionType{} }},
+	{"rename %source -> %destination", func() generatedStatement { return &genRenameRegister{} }},
+	{"restart %args using %call garbage %garbage", func() generatedStatement { return &genRestartLoop{} }},
+	{"retain %input -> %result", func() generatedStatement { return &genRetainShared{} }},
+	{"return %values garbage %garbage", func() generatedStatement { return &genReturn{} }},
+	{"shared %input -> %result", func() generatedStatement { return &genMakeShared{} }},
+	{"shared_value %input -> %result", func() generatedStatement { return &genSharedValue{} }},
+	{"string %value -> %result", func() generatedStatement { return &genStringLiteral{} }},
+	{"tuple %inputs -> %result", func() generatedStatement { return &genMakeTuple{} }},
+	{"unbox %input -> %result", func() generatedStatement { return &genUnbox{} }},
+	{"union %input variant %index -> %result", func() generatedStatement { return &genMakeUnion{} }},
+	{"untuple %input borrowed %borrowed -> %results", func() generatedStatement { return &genUnpackTuple{} }},
+}
+
+// irOperands returns pointers to the operands of a statement, in the order
+// that its syntax in irOps has them.
+func irOperands(stmt generatedStatement) []interface{} {
+	switch s := stmt.(type) {
+	case *genAfter:
+		return []interface{}{&s.Statement, &s.Waits}
+	case *genArithmetic:
+		return []interface{}{&s.Left, &s.Op, &s.Right, &s.Kind, &s.Result, &s.Position}
+	case *genNewArray:
+		return []interface{}{&s.Values, &s.Result}
+	case *genMakeBox:
+		return []interface{}{&s.Input, &s.Result}
+	case *genBranch:
+		return []interface{}{&s.Condition, &s.IfTrue, &s.IfFalse}
+	case *genCallSyncFunction:
+		return []interface{}{&s.Name, &s.Args, &s.Result}
+	case *genCallAsyncFunction:
+		return []interface{}{&s.Name, &s.Args, &s.Result, &s.ChildCall, &s.Position}
+	case *genComment:
+		return []interface{}{&s.Message}
+	case *genNumericComparison:
+		return []interface{}{&s.Left, &s.Operation, &s.Right, &s.Kind, &s.Result}
+	case *genDrop:
+		return []interface{}{&s.Input, &s.Kind, &s.Done}
+	case *genExtractUnionValue:
+		return []interface{}{&s.Input, &s.Borrowed, &s.Result}
+	case *genFloatLiteral:
+		return []interface{}{&s.Value, &s.Target}
+	case *genInlineReturn:
+		return []interface{}{&s.ReturnValue, &s.Garbage, &s.Result}
+	case *genIntegerLiteral:
+		return []interface{}{&s.Value, &s.Target}
+	case *genCheckUnionType:
+		return []interface{}{&s.Input, &s.KindIndex, &s.Result}
+	case *genRenameRegister:
+		return []interface{}{&s.Source, &s.Destination}
+	case *genRestartLoop:
+		return []interface{}{&s.Args, &s.ChildCall, &s.Garbage}
+	case *genRetainShared:
+		return []interface{}{&s.Input, &s.Result}
+	case *genReturn:
+		return []interface{}{&s.ReturnValue, &s.Garbage}
+	case *genMakeShared:
+		return []interface{}{&s.Input, &s.Result}
+	case *genSharedValue:
+		return []interface{}{&s.Input, &s.Result}
+	case *genStringLiteral:
+		return []interface{}{&s.Value, &s.Target}
+	case *genMakeTuple:
+		return []interface{}{&s.Inputs, &s.Result}
+	case *genUnbox:
+		return []interface{}{&s.Input, &s.Result}
+	case *genMakeUnion:
+		return []interface{}{&s.Input, &s.KindIndex, &s.Result}
+	case *genUnpackTuple:
+		return []interface{}{&s.Input, &s.Borrowed, &s.Results}
+	}
+	panic(fmt.Sprintf("no IR syntax for %T", stmt))
+}
+
+// irOp is the syntax of a kind of statement, as written in irOps and split
+// into tokens.
+type irOp struct {
+	syntax string
+	tokens []string
+	new    func() generatedStatement
+}
+
+var (
+	irOpsByType = map[reflect.Type]*irOp{}
+	irOpsByName = map[string]*irOp{}
+	irOperand   = regexp.MustCompile(`%[a-z_]+`)
+)
+
+func init() {
+	for _, entry := range irOps {
+		r := &irParser{}
+		if err := r.tokenize(entry.syntax); err != nil {
+			panic(err)
+		}
+		op := &irOp{entry.syntax, r.tokens, entry.new}
+		stmt := op.new()
+		if operands := len(irOperand.FindAllString(op.syntax, -1)); operands != len(irOperands(stmt)) {
+			panic(fmt.Sprintf("%q has %d operands, but %T has %d", op.syntax, operands, stmt, len(irOperands(stmt))))
+		}
+		irOpsByType[reflect.TypeOf(stmt)] = op
+		irOpsByName[op.tokens[0]] = op
+	}
+}
+
+var (
+	registerType  = reflect.TypeOf(register(0))
+	conditionType = reflect.TypeOf(condition(0))
+	kindType      = reflect.TypeOf(&Kind{})
+)
+
+// FormatIR writes functions in the IR text format, sorted by name.
+func FormatIR(functions []*generator) string {
+	sorted := append([]*generator{}, functions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	b := &strings.Builder{}
+	for i, g := range sorted {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		g.FormatIR(b)
+	}
+	return b.String()
+}
+
+func (g *generator) FormatIR(b *strings.Builder) {
+	if g.IsNative {
+		b.WriteString("native ")
+	}
+	if g.IsClosure {
+		b.WriteString("closure ")
+	}
+	if g.IsDestructor {
+		b.WriteString("destructor ")
+	}
+
+	args := []string{}
+	for i, kind := range g.ArgKinds {
+		args = append(args, fmt.Sprintf("%s: %s", g.formatRegisterName(register(i)), formatKind(kind)))
+	}
+	results := []string{}
+	for _, kind := range g.ReturnKind {
+		results = append(results, formatKind(kind))
+	}
+	fmt.Fprintf(b, "func %s(%s) (%s)", g.Name, strings.Join(args, ", "), strings.Join(results, ", "))
+	if g.Pos.Line > 0 {
+		fmt.Fprintf(b, " at %s", formatPosition(g.Pos))
+	}
+	b.WriteString(" {\n")
+
+	for i := len(g.ArgKinds); i < len(g.Registers); i++ {
+		fmt.Fprintf(b, "  %s: %s\n", g.formatRegisterName(register(i)), formatKind(g.Registers[i]))
+	}
+	for i := range g.Registers {
+		if resolved := g.ResolveRegister(register(i)); resolved != register(i) {
+			fmt.Fprintf(b, "  r%d = r%d\n", i, resolved)
+		}
+	}
+	for c := condition(1); c <= g.NextCondition; c++ {
+		fmt.Fprintf(b, "  c%d in c%d", c, g.ConditionParents[c])
+		if sibling, ok := g.ConditionSiblings[c]; ok {
+			fmt.Fprintf(b, " else c%d", sibling)
+		}
+		b.WriteString("\n")
+	}
+	for i, name := range g.ChildCalls {
+		fmt.Fprintf(b, "  call%d: %s\n", i, name)
+	}
+	if g.slots != nil {
+		b.WriteString("  packed\n")
+	}
+	for _, share := range g.Shares {
+		regs := []string{}
+		for _, reg := range share {
+			regs = append(regs, fmt.Sprintf("r%d", reg))
+		}
+		fmt.Fprintf(b, "  share %s\n", strings.Join(regs, ", "))
+	}
+	for _, stmt := range g.Conditions {
+		fmt.Fprintf(b, "  c%d: %s", stmt.Cond, formatStatement(stmt.Statement))
+		if stmt.Pos.Line > 0 {
+			fmt.Fprintf(b, " at %s", formatPosition(stmt.Pos))
+		}
+		fmt.Fprintf(b, " // %s\n", formatDeps(stmt.Statement))
+	}
+	b.WriteString("}\n")
+}
+
+// formatRegisterName writes a register, and the variable it holds, if any.
+func (g *generator) formatRegisterName(reg register) string {
+	if name, ok := g.Names[reg]; ok {
+		return fmt.Sprintf("r%d (%s)", reg, name)
+	}
+	return fmt.Sprintf("r%d", reg)
+}
+
+func formatPosition(pos lexer.Position) string {
+	return fmt.Sprintf("%s:%d:%d", pos.Filename, pos.Line, pos.Column)
+}
+
+// formatKind writes "_" for registers that never got a kind.
+func formatKind(kind *Kind) string {
+	if kind == nil {
+		return "_"
+	}
+	return kind.String()
+}
+
+func formatStatement(stmt generatedStatement) string {
+	op := irOpsByType[reflect.TypeOf(stmt)]
+	operands := irOperands(stmt)
+	next := 0
+	return irOperand.ReplaceAllStringFunc(op.syntax, func(string) string {
+		b := &strings.Builder{}
+		formatOperand(b, operands[next])
+		next++
+		return b.String()
+	})
+}
+
+func formatDeps(stmt generatedStatement) string {
+	needs, provides := stmt.Deps()
+	parts := []string{}
+	for _, need := range needs {
+		parts = append(parts, fmt.Sprintf("r%d", need))
+	}
+	parts = append(parts, "->")
+	for _, provide := range provides {
+		parts = append(parts, fmt.Sprintf("r%d", provide))
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatOperand(b *strings.Builder, operand interface{}) {
+	switch v := operand.(type) {
+	case *register:
+		fmt.Fprintf(b, "r%d", *v)
+	case *condition:
+		fmt.Fprintf(b, "c%d", *v)
+	case *childCall:
+		fmt.Fprintf(b, "call%d", *v)
+	case **Kind:
+		b.WriteString(formatKind(*v))
+	case *generatedStatement:
+		b.WriteString(formatStatement(*v))
+	case *string:
+		b.WriteString(strconv.Quote(*v))
+	case *int:
+		b.WriteString(strconv.Itoa(*v))
+	case *int64:
+		b.WriteString(strconv.FormatInt(*v, 10))
+	case *float64:
+		b.WriteString(strconv.FormatFloat(*v, 'g', -1, 64))
+	case *bool:
+		b.WriteString(strconv.FormatBool(*v))
+	case *[]register:
+		b.WriteString("[")
+		for i := range *v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			formatOperand(b, &(*v)[i])
+		}
+		b.WriteString("]")
+	case *[]condition:
+		b.WriteString("[")
+		for i := range *v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			formatOperand(b, &(*v)[i])
+		}
+		b.WriteString("]")
+	case *map[register]*Kind:
+		b.WriteString("{")
+		for i, reg := range releasedRegisters(nil, *v) {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			kind := (*v)[reg]
+			fmt.Fprintf(b, "r%d: %s", reg, formatKind(kind))
+		}
+		b.WriteString("}")
+	case *[]borrowWait:
+		b.WriteString("[")
+		for i, wait := range *v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(b, "r%d", wait.Register)
+			if len(wait.Skipped) > 0 {
+				b.WriteString(" unless ")
+				formatOperand(b, &wait.Skipped)
+			}
+		}
+		b.WriteString("]")
+	default:
+		panic(fmt.Sprintf("can't write %T in the IR", operand))
+	}
+}
+
+// irParser reads the IR text format back, one token at a time.
+type irParser struct {
+	p      *program
+	tokens []string
+	line   []int
+	next   int
+}
+
+// ParseIR reads functions written by FormatIR, resolving their kinds against
+// the types declared in p.
+func ParseIR(p *program, text string) (functions []*generator, err error) {
+	r := &irParser{p: p}
+	if err := r.tokenize(text); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			parseErr, ok := recovered.(irError)
+			if !ok {
+				panic(recovered)
+			}
+			functions, err = nil, parseErr
+		}
+	}()
+
+	for r.next < len(r.tokens) {
+		functions = append(functions, r.function())
+	}
+	return functions, nil
+}
+
+type irError struct {
+	line    int
+	message string
+}
+
+func (e irError) Error() string {
+	return fmt.Sprintf("IR line %d: %s", e.line, e.message)
+}
+
+func (r *irParser) tokenize(text string) error {
+	line := 1
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case unicode.IsSpace(c):
+			i++
+		case c == '#' || strings.HasPrefix(text[i:], "//"):
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			quoted, err := strconv.QuotedPrefix(text[i:])
+			if err != nil {
+				return irError{line, fmt.Sprintf("bad string: %v", err)}
+			}
+			r.tokens = append(r.tokens, quoted)
+			r.line = append(r.line, line)
+			i += len(quoted)
+		case strings.ContainsRune("{}[](),:=&", c):
+			r.tokens = append(r.tokens, string(c))
+			r.line = append(r.line, line)
+			i++
+		default:
+			start := i
+			for i < len(text) && !unicode.IsSpace(rune(text[i])) && !strings.ContainsRune("{}[](),:=&\"", rune(text[i])) {
+				i++
+			}
+			r.tokens = append(r.tokens, text[start:i])
+			r.line = append(r.line, line)
+		}
+	}
+	return nil
+}
+
+func (r *irParser) fail(format string, args ...interface{}) {
+	line := 0
+	if r.next < len(r.line) {
+		line = r.line[r.next]
+	} else if len(r.line) > 0 {
+		line = r.line[len(r.line)-1]
+	}
+	panic(irError{line, fmt.Sprintf(format, args...)})
+}
+
+func (r *irParser) peek() string {
+	if r.next >= len(r.tokens) {
+		return ""
+	}
+	return r.tokens[r.next]
+}
+
+func (r *irParser) take() string {
+	token := r.peek()
+	if token == "" {
+		r.fail("unexpected end of IR")
+	}
+	r.next++
+	return token
+}
+
+func (r *irParser) expect(token string) {
+	if got := r.take(); got != token {
+		r.fail("expecting %q, got %q", token, got)
+	}
+}
+
+// number reads a token such as "r3" or "call2".
+func (r *irParser) number(prefix string) int {
+	token := r.take()
+	n, err := strconv.Atoi(strings.TrimPrefix(token, prefix))
+	if err != nil || !strings.HasPrefix(token, prefix) {
+		r.fail("expecting %sN, got %q", prefix, token)
+	}
+	return n
+}
+
+// list reads a comma separated list, up to the closing token.
+func (r *irParser) list(close string, item func()) {
+	for r.peek() != close {
+		item()
+		if r.peek() != close {
+			r.expect(",")
+		}
+	}
+	r.expect(close)
+}
+
+func (r *irParser) kind() *Kind {
+	if r.peek() == "_" {
+		r.take()
+		return nil
+	}
+	kind, err := r.p.ResolveType(r.typeRep())
+	if err != nil {
+		r.fail("%v", err)
+	}
+	return kind
+}
+
+func (r *irParser) typeRep() *TypeRep {
+	rep := &TypeRep{}
+	if r.peek() == "&" {
+		r.take()
+		rep.Borrowed = true
+	}
+	rep.Name = r.take()
+	if r.peek() == "[" {
+		r.take()
+		r.list("]", func() { rep.Args = append(rep.Args, r.typeRep()) })
+	}
+	return rep
+}
+
+// registerName reads the name of the variable in a register, if it has one.
+func (r *irParser) registerName(g *generator, reg register) {
+	if r.peek() == "(" {
+		r.take()
+		g.Names[reg] = r.take()
+		r.expect(")")
+	}
+}
+
+// position reads "file:line:column".
+func (r *irParser) position() lexer.Position {
+	pos := lexer.Position{Filename: r.take()}
+	r.expect(":")
+	pos.Line = r.number("")
+	r.expect(":")
+	pos.Column = r.number("")
+	return pos
+}
+
+func (r *irParser) function() *generator {
+	g := &generator{
+		Names:             map[register]string{},
+		Substitutions:     map[register]register{},
+		ConditionParents:  map[condition]condition{},
+		ConditionSiblings: map[condition]condition{},
+	}
+	for r.peek() != "func" {
+		switch flag := r.take(); flag {
+		case "native":
+			g.IsNative = true
+		case "closure":
+			g.IsClosure = true
+		case "destructor":
+			g.IsDestructor = true
+		default:
+			r.fail("unknown function flag %q", flag)
+		}
+	}
+	r.expect("func")
+	g.Name = r.take()
+
+	r.expect("(")
+	r.list(")", func() {
+		if reg := r.number("r"); reg != len(g.ArgKinds) {
+			r.fail("expecting argument r%d, got r%d", len(g.ArgKinds), reg)
+		}
+		r.registerName(g, register(len(g.ArgKinds)))
+		r.expect(":")
+		g.ArgKinds = append(g.ArgKinds, r.kind())
+	})
+	if g.IsDestructor && len(g.ArgKinds) > 0 {
+		// As in astFunction.Generate.
+		inner := *g.ArgKinds[0]
+		inner.Destructor = ""
+		g.ArgKinds[0] = &inner
+	}
+	g.Registers = append([]*Kind{}, g.ArgKinds...)
+
+	r.expect("(")
+	r.list(")", func() { g.ReturnKind = append(g.ReturnKind, r.kind()) })
+	g.Results = len(g.ReturnKind)
+	if r.peek() == "at" {
+		r.take()
+		g.Pos = r.position()
+	}
+
+	r.expect("{")
+	packed := false
+	for r.peek() != "}" {
+		switch token := r.peek(); {
+		case token == "packed":
+			r.take()
+			packed = true
+
+		case token == "share":
+			r.take()
+			share := []register{register(r.number("r"))}
+			for r.peek() == "," {
+				r.take()
+				share = append(share, register(r.number("r")))
+			}
+			g.Shares = append(g.Shares, share)
+
+		case strings.HasPrefix(token, "call"):
+			if id := r.number("call"); id != len(g.ChildCalls) {
+				r.fail("expecting call%d, got call%d", len(g.ChildCalls), id)
+			}
+			r.expect(":")
+			g.ChildCalls = append(g.ChildCalls, r.take())
+
+		case strings.HasPrefix(token, "r"):
+			reg := register(r.number("r"))
+			if r.peek() == "=" {
+				r.take()
+				g.Substitutions[reg] = register(r.number("r"))
+				continue
+			}
+			if int(reg) != len(g.Registers) {
+				r.fail("expecting r%d, got r%d", len(g.Registers), reg)
+			}
+			r.registerName(g, reg)
+			r.expect(":")
+			g.Registers = append(g.Registers, r.kind())
+
+		case strings.HasPrefix(token, "c"):
+			c := condition(r.number("c"))
+			if r.peek() == "in" {
+				r.take()
+				g.ConditionParents[c] = condition(r.number("c"))
+				if r.peek() == "else" {
+					r.take()
+					g.ConditionSiblings[c] = condition(r.number("c"))
+				}
+				if c > g.NextCondition {
+					g.NextCondition = c
+				}
+				continue
+			}
+			r.expect(":")
+			stmt := stmtWithCondition{Cond: c, Statement: r.statement()}
+			if r.peek() == "at" {
+				r.take()
+				stmt.Pos = r.position()
+			}
+			g.Conditions = append(g.Conditions, stmt)
+
+		default:
+			r.fail("unexpected %q", token)
+		}
+	}
+	r.expect("}")
+	if packed {
+		g.AssignSlots()
+	}
+	return g
+}
+
+func (r *irParser) statement() generatedStatement {
+	name := r.peek()
+	op, ok := irOpsByName[name]
+	if !ok {
+		r.fail("unknown statement %q", name)
+	}
+	stmt := op.new()
+	operands := irOperands(stmt)
+	for _, token := range op.tokens {
+		if strings.HasPrefix(token, "%") {
+			r.operand(operands[0])
+			operands = operands[1:]
+		} else {
+			r.expect(token)
+		}
+	}
+	return stmt
+}
+
+func (r *irParser) operand(operand interface{}) {
+	switch v := operand.(type) {
+	case *register:
+		*v = register(r.number("r"))
+	case *condition:
+		*v = condition(r.number("c"))
+	case *childCall:
+		*v = childCall(r.number("call"))
+	case **Kind:
+		*v = r.kind()
+	case *generatedStatement:
+		*v = r.statement()
+	case *string:
+		s, err := strconv.Unquote(r.take())
+		if err != nil {
+			r.fail("bad string: %v", err)
+		}
+		*v = s
+	case *int:
+		*v = r.number("")
+	case *int64:
+		n, err := strconv.ParseInt(r.take(), 10, 64)
+		if err != nil {
+			r.fail("bad integer: %v", err)
+		}
+		*v = n
+	case *float64:
+		f, err := strconv.ParseFloat(r.take(), 64)
+		if err != nil {
+			r.fail("bad float: %v", err)
+		}
+		*v = f
+	case *bool:
+		b, err := strconv.ParseBool(r.take())
+		if err != nil {
+			r.fail("bad boolean: %v", err)
+		}
+		*v = b
+	case *[]register:
+		*v = []register{}
+		r.expect("[")
+		r.list("]", func() { *v = append(*v, register(r.number("r"))) })
+	case *[]condition:
+		*v = []condition{}
+		r.expect("[")
+		r.list("]", func() { *v = append(*v, condition(r.number("c"))) })
+	case *map[register]*Kind:
+		*v = map[register]*Kind{}
+		r.expect("{")
+		r.list("}", func() {
+			reg := register(r.number("r"))
+			r.expect(":")
+			(*v)[reg] = r.kind()
+		})
+	case *[]borrowWait:
+		*v = []borrowWait{}
+		r.expect("[")
+		r.list("]", func() {
+			wait := borrowWait{Register: register(r.number("r")), Skipped: []condition{}}
+			if r.peek() == "unless" {
+				r.take()
+				r.operand(&wait.Skipped)
+			}
+			*v = append(*v, wait)
+		})
+	default:
+		r.fail("can't read %T from the IR", operand)
+	}
+}
+
+// DumpIR appends the current IR to w, after checking that it reads back
+// unchanged.
+func (p *program) DumpIR(w *strings.Builder, pass string) error {
+	text := FormatIR(p.GeneratedFunctions)
+	functions, err := ParseIR(p, text)
+	if err != nil {
+		return fmt.Errorf("after %s: %v", pass, err)
+	}
+	if FormatIR(functions) != text {
+		return fmt.Errorf("after %s: IR doesn't read back unchanged", pass)
+	}
+	fmt.Fprintf(w, "# after %s\n\n%s\n", pass, text)
+	return nil
+}
+
+// ReloadIR replaces the generated functions with what reading back their IR
+// gives, so that the C code is generated from only what the IR holds. The
+// passes before the C backend need more than that.
+func (p *program) ReloadIR() error {
+	functions, err := ParseIR(p, FormatIR(p.GeneratedFunctions))
+	if err != nil {
+		return err
+	}
+	byName := map[string]*generator{}
+	for _, g := range functions {
+		byName[g.Name] = g
+	}
+	for i, g := range p.GeneratedFunctions {
+		p.GeneratedFunctions[i] = byName[g.Name]
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+// The C code for each statement is preceded by #line directives naming the
+// source statement it was generated for, so that compiler errors, sanitizer
+// reports and debuggers point at the .ht file. Everything else (guards,
+// wakeups, the runtime calling convention) stays attributed to the C file.
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// cLineMarker stands for a #line directive back to the generated C code,
+// which setLineDirectives fills in once the line numbers are known.
+const cLineMarker = "#line C"
+
+// formatAtSource writes the C code for a statement, with each line attributed
+// to pos, and then switches back to the C file.
+func formatAtSource(code string, pos lexer.Position, sourceDir string, w io.Writer) {
+	if pos.Line == 0 {
+		fmt.Fprintf(w, "%s", code)
+		return
+	}
+	directive := fmt.Sprintf("#line %d %s\n", pos.Line, strconv.Quote(joinPath(sourceDir, pos.Filename)))
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(code, "\n"), "\n") {
+		fmt.Fprintf(w, "%s%s", directive, line)
+	}
+	fmt.Fprintf(w, "\n%s\n", cLineMarker)
+}
+
+// setLineDirectives replaces each cLineMarker with a directive that gives the
+// following line its own line number in filename.
+func setLineDirectives(code string, filename string) string {
+	lines := strings.Split(code, "\n")
+	for i, line := range lines {
+		if line == cLineMarker {
+			lines[i] = fmt.Sprintf("#line %d %s", i+2, strconv.Quote(filename))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// joinPath puts a file name in a directory, if there is one.
+func joinPath(dir string, name string) string {
+	if dir == "" {
+		return name
+	}
+	return strings.TrimSuffix(dir, "/") + "/" + name
+}
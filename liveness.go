@@ -0,0 +1,389 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unique_effect
+
+// Each register is a slot in sp->r, but most registers only hold a value for
+// a short time. ShareSlots lets registers whose lifetimes don't overlap take
+// turns using the same slot.
+//
+// Statements can run in any order that their dependencies allow, so a
+// register A only gives its slot to a register B when:
+//
+//   - A is read by exactly one statement U, which clears the slot after it
+//     runs, and
+//   - U always runs before the statement that writes B, because that
+//     statement (indirectly) needs something only U provides.
+//
+// A slot's ready flag is shared too, so each register in a share (except the
+// last) has a flag in sp->consumed that says whether U has run. A register
+// owns the slot once the register before it is consumed, and until it is
+// consumed itself; see generator.Ready.
+//
+// Registers that other functions read or write (arguments, results of calls,
+// and the state handed to the next iteration of a loop) are never shared.
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// slotOwner records when a register in a share owns its slot, as indices
+// into sp->consumed (or -1).
+type slotOwner struct {
+	After, Until int
+}
+
+// ShareSlots finds registers that can share slots, and assigns the slots.
+func (g *generator) ShareSlots() {
+	if g.IsNative {
+		return
+	}
+
+	external := map[register]bool{}
+	for _, reg := range g.wakeups().External {
+		external[reg] = true
+	}
+
+	// Which statements write and mention each register.
+	providers := map[register][]int{}
+	mentions := map[register][]int{}
+	async := make([]bool, len(g.Conditions))
+	for i, stmt := range g.Conditions {
+		_, provides := stmt.Statement.Deps()
+		for _, reg := range provides {
+			reg = g.ResolveRegister(reg)
+			providers[reg] = append(providers[reg], i)
+		}
+		for _, reg := range registersIn(stmt.Statement) {
+			reg = g.ResolveRegister(reg)
+			if n := len(mentions[reg]); n == 0 || mentions[reg][n-1] != i {
+				mentions[reg] = append(mentions[reg], i)
+			}
+		}
+		switch unwrapStatement(stmt.Statement).(type) {
+		case *genCallAsyncFunction, *genRestartLoop, *genReturn:
+			async[i] = true
+		}
+	}
+
+	shareable := func(reg register) bool {
+		if int(reg) < len(g.ArgKinds) || external[reg] || len(providers[reg]) != 1 {
+			return false
+		}
+		for _, i := range mentions[reg] {
+			if async[i] {
+				return false
+			}
+		}
+		return true
+	}
+	// reader is the only statement that reads a register (other than the one
+	// that writes it), or -1.
+	reader := func(reg register) int {
+		users := []int{}
+		for _, i := range mentions[reg] {
+			if i != providers[reg][0] {
+				users = append(users, i)
+			}
+		}
+		if len(users) != 1 {
+			return -1
+		}
+		needs, provides := g.Conditions[users[0]].Statement.Deps()
+		if !containsRegister(g, needs, reg) || containsRegister(g, provides, reg) {
+			return -1
+		}
+		return users[0]
+	}
+
+	before := g.statementsBefore(providers)
+
+	// Registers in the order they are written. Each one takes over the first
+	// slot that is free by then.
+	candidates := []register{}
+	for reg := range providers {
+		if reg == g.ResolveRegister(reg) && shareable(reg) {
+			candidates = append(candidates, reg)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := providers[candidates[i]][0], providers[candidates[j]][0]
+		if a != b {
+			return a < b
+		}
+		return candidates[i] < candidates[j]
+	})
+
+	type openShare struct {
+		Index  int // in g.Shares, or -1 before it has two registers
+		Last   register
+		Reader int
+	}
+	open := []openShare{}
+	g.Shares = nil
+	for _, reg := range candidates {
+		writer := providers[reg][0]
+		index := -1
+		for i, share := range open {
+			if !before[writer].Has(share.Reader) {
+				continue
+			}
+			index = share.Index
+			if index < 0 {
+				index = len(g.Shares)
+				g.Shares = append(g.Shares, []register{share.Last})
+			}
+			g.Shares[index] = append(g.Shares[index], reg)
+			open = append(open[:i], open[i+1:]...)
+			break
+		}
+		if r := reader(reg); r >= 0 {
+			open = append(open, openShare{index, reg, r})
+		}
+	}
+	g.AssignSlots()
+}
+
+// registersIn lists every register that a statement refers to.
+func registersIn(stmt generatedStatement) []register {
+	result := []register{}
+	var visit func(v reflect.Value)
+	visit = func(v reflect.Value) {
+		if v.Type() == registerType {
+			result = append(result, register(v.Int()))
+			return
+		}
+		switch v.Kind() {
+		case reflect.Interface, reflect.Ptr:
+			if !v.IsNil() {
+				visit(v.Elem())
+			}
+		case reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				visit(v.Index(i))
+			}
+		case reflect.Map:
+			for _, key := range v.MapKeys() {
+				visit(key)
+			}
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				visit(v.Field(i))
+			}
+		}
+	}
+	visit(reflect.ValueOf(stmt))
+	return result
+}
+
+func containsRegister(g *generator, regs []register, reg register) bool {
+	for _, r := range regs {
+		if g.ResolveRegister(r) == reg {
+			return true
+		}
+	}
+	return false
+}
+
+// statementSet is a set of statements, by index.
+type statementSet []uint64
+
+func (s statementSet) Has(i int) bool {
+	return s[i/64]&(1<<(i%64)) != 0
+}
+
+// statementsBefore finds, for each statement, the statements that must have
+// run before it can. Values written by several statements (in different
+// branches) don't say which one ran, so they don't count.
+func (g *generator) statementsBefore(providers map[register][]int) []statementSet {
+	words := (len(g.Conditions) + 63) / 64
+	before := make([]statementSet, len(g.Conditions))
+	var visit func(i int) statementSet
+	visit = func(i int) statementSet {
+		if before[i] != nil {
+			return before[i]
+		}
+		before[i] = make(statementSet, words)
+		needs, _ := g.Conditions[i].Statement.Deps()
+		for _, need := range needs {
+			writers := providers[g.ResolveRegister(need)]
+			if len(writers) != 1 || writers[0] == i {
+				continue
+			}
+			writer := writers[0]
+			before[i][writer/64] |= 1 << (writer % 64)
+			for word, bits := range visit(writer) {
+				before[i][word] |= bits
+			}
+		}
+		return before[i]
+	}
+	for i := range g.Conditions {
+		visit(i)
+	}
+	return before
+}
+
+// AssignSlots numbers the slots in sp->r, from g.Shares. Arguments keep
+// their own slots, since callers fill them in, and registers that no
+// statement refers to get none.
+func (g *generator) AssignSlots() {
+	g.slots = map[register]int{}
+	g.owners = map[register]slotOwner{}
+	g.frameSize = 0
+	g.Consumed = 0
+
+	used := map[register]bool{}
+	for _, stmt := range g.Conditions {
+		for _, reg := range registersIn(stmt.Statement) {
+			used[g.ResolveRegister(reg)] = true
+		}
+	}
+
+	first := map[register][]register{}
+	later := map[register]bool{}
+	for _, share := range g.Shares {
+		first[share[0]] = share
+		for _, reg := range share[1:] {
+			later[reg] = true
+		}
+	}
+
+	for i := range g.Registers {
+		reg := register(i)
+		if i >= len(g.ArgKinds) && (g.ResolveRegister(reg) != reg || !used[reg] || later[reg]) {
+			continue
+		}
+		slot := g.frameSize
+		g.frameSize++
+		share, ok := first[reg]
+		if !ok {
+			g.slots[reg] = slot
+			continue
+		}
+		after := -1
+		for j, member := range share {
+			g.slots[member] = slot
+			owner := slotOwner{After: after, Until: -1}
+			if j < len(share)-1 {
+				owner.Until = g.Consumed
+				after = g.Consumed
+				g.Consumed++
+			}
+			g.owners[member] = owner
+		}
+	}
+}
+
+// FrameSize is the number of slots in sp->r.
+func (g *generator) FrameSize() int {
+	if g.slots == nil {
+		return len(g.Registers)
+	}
+	return g.frameSize
+}
+
+// owns is the C condition for r owning its slot, if it shares one.
+func (g generator) owns(r register) string {
+	owner, ok := g.owners[g.ResolveRegister(r)]
+	if !ok {
+		return ""
+	}
+	result := ""
+	if owner.After >= 0 {
+		result += fmt.Sprintf(" && sp->consumed[%d]", owner.After)
+	}
+	if owner.Until >= 0 {
+		result += fmt.Sprintf(" && !sp->consumed[%d]", owner.Until)
+	}
+	return result
+}
+
+// Ready is the C condition for r having a value.
+func (g generator) Ready(r register) string {
+	if owns := g.owns(r); owns != "" {
+		return fmt.Sprintf("(%s.ready%s)", g.Reg(r), owns)
+	}
+	return fmt.Sprintf("%s.ready", g.Reg(r))
+}
+
+// NotReady is the C condition for r not having a value yet.
+func (g generator) NotReady(r register) string {
+	if owns := g.owns(r); owns != "" {
+		return fmt.Sprintf("(!%s.ready%s)", g.Reg(r), owns)
+	}
+	return fmt.Sprintf("!%s.ready", g.Reg(r))
+}
+
+// Cancel marks r as cancelled, if it has its slot.
+func (g generator) Cancel(r register, indent string, w io.Writer) {
+	if owns := g.owns(r); owns != "" {
+		fmt.Fprintf(w, "%sif (%s) %s.cancelled = true;\n", indent, strings.TrimPrefix(owns, " && "), g.Reg(r))
+		return
+	}
+	fmt.Fprintf(w, "%s%s.cancelled = true;\n", indent, g.Reg(r))
+}
+
+// formatConsume hands the slots of registers that a statement was the last
+// to read over to the registers that share them.
+func (g *generator) formatConsume(stmt generatedStatement, w io.Writer) {
+	needs, _ := stmt.Deps()
+	for _, need := range needs {
+		if owner, ok := g.owners[g.ResolveRegister(need)]; ok && owner.Until >= 0 {
+			fmt.Fprintf(w, "    sp->consumed[%d] = true;\n", owner.Until)
+			fmt.Fprintf(w, "    %s = (future_t){.ready = false};\n", g.Reg(need))
+		}
+	}
+}
+
+// FrameSizes records how many registers each function has.
+func FrameSizes(functions []*generator) map[string]int {
+	result := map[string]int{}
+	for _, g := range functions {
+		if !g.IsNative {
+			result[g.Name] = g.FrameSize()
+		}
+	}
+	return result
+}
+
+// FormatFrameStats reports how many slots each function's state needs, now
+// and before (as recorded by FrameSizes). Functions that were inlined or
+// never called are gone.
+func FormatFrameStats(before map[string]int, functions []*generator, w io.Writer) {
+	after := FrameSizes(functions)
+	names := []string{}
+	for name := range before {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	totalBefore, totalAfter := 0, 0
+	fmt.Fprintf(w, "registers in the state of each function, before and after optimizing:\n")
+	for _, name := range names {
+		size, ok := after[name]
+		if ok {
+			fmt.Fprintf(w, "  %s: %d -> %d\n", name, before[name], size)
+		} else {
+			fmt.Fprintf(w, "  %s: %d -> removed\n", name, before[name])
+		}
+		totalBefore += before[name]
+		totalAfter += size
+	}
+	fmt.Fprintf(w, "  total: %d -> %d\n", totalBefore, totalAfter)
+}
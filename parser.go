@@ -16,6 +16,8 @@ package unique_effect
 
 import (
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 
 	"github.com/alecthomas/participle/v2"
@@ -36,6 +38,11 @@ type Kind struct {
 	Family           Family
 	TupleOrUnionArgs []*Kind
 	Label            string
+
+	// Linear values must be consumed explicitly, and are never dropped.
+	Linear bool
+	// Destructor is the function called when a value of this kind is dropped.
+	Destructor string
 }
 
 const (
@@ -48,6 +55,10 @@ const (
 	FamilyArray
 	FamilyFileSystem
 	FamilyUnion
+	FamilyNone
+	FamilyBox
+	FamilyFloat64
+	FamilyShared
 	FamilyCustom
 )
 
@@ -71,6 +82,14 @@ func (f Family) String() string {
 		return "FileSystem"
 	case FamilyUnion:
 		return "Union"
+	case FamilyNone:
+		return "None"
+	case FamilyBox:
+		return "Box"
+	case FamilyFloat64:
+		return "Float64"
+	case FamilyShared:
+		return "Shared"
 	case FamilyCustom:
 		return "Custom"
 	default:
@@ -86,8 +105,11 @@ func CaptureFamily(name string) (Family, error) {
 		return FamilyStream, nil
 	case "Clock":
 		return FamilyClock, nil
-	case "Integer":
+	case "Integer", "Int32", "Int64", "UInt64":
+		// Sized integers are distinguished by their labels.
 		return FamilyInteger, nil
+	case "Float64":
+		return FamilyFloat64, nil
 	case "Boolean":
 		return FamilyBoolean, nil
 	case "Array":
@@ -96,6 +118,12 @@ func CaptureFamily(name string) (Family, error) {
 		return FamilyFileSystem, nil
 	case "Union":
 		return FamilyUnion, nil
+	case "None":
+		return FamilyNone, nil
+	case "Box":
+		return FamilyBox, nil
+	case "Shared":
+		return FamilyShared, nil
 	default:
 		return FamilyCustom, nil
 	}
@@ -107,6 +135,14 @@ func (k Kind) String() string {
 		result += "&"
 	}
 	result += k.Label
+	if k.IsStruct() {
+		// Structs are named, and may contain themselves.
+		return result
+	}
+	if k.Label == "Option" {
+		// The None option is implied by the label.
+		return result + "[" + k.TupleOrUnionArgs[0].String() + "]"
+	}
 	if len(k.TupleOrUnionArgs) > 0 {
 		result += "["
 		for i, arg := range k.TupleOrUnionArgs {
@@ -127,6 +163,9 @@ func (k Kind) CanConvertTo(other Kind) error {
 	if !other.Borrowed && k.Borrowed {
 		return fmt.Errorf("Type error, expecting owned %v, but got %v", other, k)
 	}
+	if mismatch := k.argumentMismatch(other, other.Borrowed); mismatch != "" {
+		return fmt.Errorf("Type error, expecting %v, got %v (%s)", other, k, mismatch)
+	}
 	return nil
 }
 
@@ -134,29 +173,121 @@ func (k Kind) IsEquivalent(other Kind) error {
 	if k.Family != other.Family || k.Label != other.Label || k.Borrowed != other.Borrowed {
 		return fmt.Errorf("%v vs. %v", other, k)
 	}
+	if mismatch := k.argumentMismatch(other, false); mismatch != "" {
+		return fmt.Errorf("%v vs. %v (%s)", other, k, mismatch)
+	}
 	return nil
 }
 
+// argumentMismatch compares type arguments recursively, describing the
+// innermost one that differs. Everything reachable through a borrow is read
+// only, so there an owned argument may stand in for a borrowed one; otherwise
+// the arguments must match exactly.
+func (k Kind) argumentMismatch(other Kind, readOnly bool) string {
+	if len(k.TupleOrUnionArgs) != len(other.TupleOrUnionArgs) {
+		return fmt.Sprintf("expecting %d type arguments, got %d", len(other.TupleOrUnionArgs), len(k.TupleOrUnionArgs))
+	}
+
+	if other.IsStruct() {
+		// Structs with the same name always have the same fields.
+		return ""
+	}
+
+	for i, arg := range k.TupleOrUnionArgs {
+		expected := other.TupleOrUnionArgs[i]
+		compatible := arg.Family == expected.Family && arg.Label == expected.Label
+		if readOnly {
+			compatible = compatible && (expected.Borrowed || !arg.Borrowed)
+		} else {
+			compatible = compatible && expected.Borrowed == arg.Borrowed
+		}
+		if !compatible {
+			return fmt.Sprintf("type argument %d of %s: expecting %v, got %v", i+1, other.Label, expected, arg)
+		}
+
+		if mismatch := arg.argumentMismatch(*expected, readOnly || expected.Borrowed); mismatch != "" {
+			return fmt.Sprintf("type argument %d of %s: %s", i+1, other.Label, mismatch)
+		}
+	}
+	return ""
+}
+
+// CanHold reports whether a value of the given kind can be returned as k,
+// either directly or by wrapping it into a union.
+func (k Kind) CanHold(other Kind) bool {
+	if other.CanConvertTo(k) == nil {
+		return true
+	}
+	if k.Family == FamilyUnion {
+		for _, option := range k.UnpackAsUnion() {
+			if other.CanConvertTo(*option) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (k Kind) NeedsToBeDeleted() bool {
 	return !k.IsPrimitive() && !k.Borrowed
 }
 
 func (k Kind) CanBeImplicitlyDeleted() bool {
-	return k.Family == FamilyString || k.Family == FamilyArray
+	return k.canBeDropped(map[string]bool{})
+}
+
+func (k Kind) canBeDropped(visiting map[string]bool) bool {
+	if k.Linear {
+		return false
+	}
+	if k.Destructor != "" || k.Family == FamilyString || k.Family == FamilyShared {
+		// Only droppable values can be shared, see buildShare.
+		return true
+	}
+	if k.Family != FamilyArray && k.Family != FamilyTuple && k.Family != FamilyUnion && k.Family != FamilyBox {
+		return false
+	}
+
+	if k.IsStruct() {
+		if visiting[k.Label] {
+			// A recursive struct doesn't own anything new the second time.
+			return true
+		}
+		visiting[k.Label] = true
+	}
+
+	// Containers can be dropped if everything they own can be.
+	for _, arg := range k.TupleOrUnionArgs {
+		if arg.NeedsToBeDeleted() && !arg.canBeDropped(visiting) {
+			return false
+		}
+	}
+	return true
 }
 
 func (k Kind) IsPrimitive() bool {
-	return k.Family == FamilyInteger || k.Family == FamilyBoolean
+	return k.IsNumeric() || k.Family == FamilyBoolean || k.Family == FamilyNone
+}
+
+// IsStruct reports whether k was declared with "struct", rather than being an
+// anonymous Tuple.
+func (k Kind) IsStruct() bool {
+	return k.Family == FamilyTuple && k.Label != "Tuple"
 }
 
 func (k Kind) IsNumeric() bool {
-	return k.Family == FamilyInteger
+	return k.Family == FamilyInteger || k.Family == FamilyFloat64
 }
 
 func (k Kind) IsBooleanLike() bool {
 	return k.Family == FamilyBoolean
 }
 
+// IsFailure reports whether this is the kind propagated by the "?" operator.
+func (k Kind) IsFailure() bool {
+	return k.Family == FamilyNone || k.Label == "Error"
+}
+
 func (k Kind) CanBeArgumentToMain() bool {
 	return k.Family == FamilyClock || k.Family == FamilyStream || k.Family == FamilyFileSystem
 }
@@ -185,20 +316,64 @@ type astImport struct {
 type astFunctionOrStruct struct {
 	Function *astFunction `  @@`
 	Struct   *astStruct   `| @@`
+	Alias    *astAlias    `| @@`
+	Trait    *astTrait    `| @@`
+	Impl     *astImpl     `| @@`
+}
+
+// astTrait declares the methods that every implementation of a trait has.
+// Their first argument is Self (or &Self), which is what calls dispatch on.
+type astTrait struct {
+	Name    string         `"trait" @Ident "{" EOL+`
+	Methods []*astFunction `@@* "}" EOL+`
+}
+
+// astImpl implements a trait's methods for one type. Each method is renamed
+// after the type, so "show" for Integer becomes the function "show_Integer".
+// An impl with type parameters, such as "impl[T: Show] Show for Array[T]",
+// covers every type that matches, and its methods are generic functions.
+type astImpl struct {
+	TypeParams []*astTypeParam `"impl" ("[" @@ ("," @@)* "]")?`
+	Trait      string          `@Ident "for"`
+	Kind       *TypeRep        `@@ "{" EOL+`
+	Methods    []*astFunction  `@@* "}" EOL+`
+
+	// Functions maps each method of the trait to the function implementing it.
+	Functions map[string]string
+}
+
+type astAlias struct {
+	Name string   `"type" @Ident "="`
+	Kind *TypeRep `@@ EOL+`
 }
 
 type astStruct struct {
-	Name   string     `"struct" @Ident`
-	Fields []*TypeRep `"{" (EOL+ (@@ EOL+)+)? "}" EOL+`
+	IsLinear bool       `@"linear"?`
+	Name     string     `"struct" @Ident`
+	Fields   []*TypeRep `"{" (EOL+ (@@ EOL+)+)? "}" EOL+`
 }
 
 type astFunction struct {
-	IsSynchronous bool       `@"sync"?`
-	IsNative      bool       `@"native"?`
-	Name          string     `'func' @Ident`
-	Args          []*astArg  `'(' @@* (',' @@*)* ')'`
-	ReturnKind    []*TypeRep `":" (@@ | "(" @@ ("," @@)* ")")`
-	Block         *astBlock  `@@? EOL+`
+	IsSynchronous bool            `@"sync"?`
+	IsNative      bool            `@"native"?`
+	Name          string          `'func' @Ident`
+	TypeParams    []*astTypeParam `("[" @@ ("," @@)* "]")?`
+	Args          []*astArg       `'(' @@* (',' @@*)* ')'`
+	ReturnKind    []*TypeRep      `":" (@@ | "(" (@@ ("," @@)*)? ")")`
+	Block         *astBlock       `@@? EOL+`
+
+	// IsDestructor is set for functions named "drop", which are called when
+	// a value of their argument's type is dropped.
+	IsDestructor bool
+
+	Pos lexer.Position
+}
+
+// astTypeParam is a type parameter of a generic function, along with the
+// traits that its type arguments must implement.
+type astTypeParam struct {
+	Name   string   `@Ident`
+	Bounds []string `(":" @Ident ("+" @Ident)*)?`
 }
 
 func (a *astFunction) ReturnValue(p *program, args []*Kind) ([]*Kind, error) {
@@ -229,12 +404,18 @@ func (a *astFunction) ReturnValue(p *program, args []*Kind) ([]*Kind, error) {
 }
 
 type astArg struct {
-	Name string   `@Ident`
-	Kind *TypeRep `':' @@`
+	Name    string      `( @Ident`
+	Pattern *astPattern `| @@ )`
+	Kind    *TypeRep    `':' @@`
+
+	Pos lexer.Position
 }
 
 type astBlock struct {
 	Statements []*astStmt `'{' EOL* @@* '}'`
+
+	Pos    lexer.Position
+	EndPos lexer.Position
 }
 
 type astStmt struct {
@@ -249,13 +430,32 @@ type astStmt struct {
 }
 
 type astLetStmt struct {
-	MustExist bool           `("let" | @"set")`
-	VarNames  []string       `@Ident ("," @Ident)*`
-	Value     *astExpression `"=" @@`
+	MustExist bool             `("let" | @"set")`
+	Bindings  []*astLetBinding `@@ ("," @@)*`
+	Value     *astExpression   `"=" @@`
+}
+
+type astLetBinding struct {
+	Pattern *astPattern `@@`
+	Kind    *TypeRep    `(":" @@)?`
+
+	Pos lexer.Position
+}
+
+// astPattern names a value, ignores it with "_", or unpacks a tuple (or
+// struct) into more patterns.
+type astPattern struct {
+	Wildcard bool          `  @"_"`
+	Tuple    []*astPattern `| "(" @@ ("," @@)+ ")"`
+	Name     string        `| @Ident`
+
+	Pos lexer.Position
 }
 
 type astReturnStmt struct {
-	Value *astExpression `"return" @@`
+	Value *astExpression `"return" @@?`
+
+	Pos lexer.Position
 }
 
 type astRepeatStmt struct {
@@ -271,11 +471,15 @@ type astConditionalStmt struct {
 }
 
 type astMethodCall struct {
-	Args []*astMethodArg `"(" @@ (',' @@)* ")"`
+	Args []*astMethodArg `"(" (@@ (',' @@)*)? ")"`
 }
 
+// astMethodArg is an argument to a call. "&mut x" passes x in-out: it's
+// moved into the call, and rebound to the matching result. "&x" lends x to a
+// borrowed parameter, read-only, and anything else is passed as is.
 type astMethodArg struct {
-	Borrow *string        `  "&" @Ident`
+	InOut  *string        `  "&" "mut" @Ident`
+	Shared *string        `| "&" @Ident`
 	Expr   *astExpression `| @@`
 
 	Pos lexer.Position
@@ -289,33 +493,59 @@ type astExpression struct {
 }
 
 type astComparison struct {
-	Cond    string            `@(">=" | "<=" | "<" | ">")`
+	Cond    string            `@(">=" | "<=" | "==" | "!=" | "<" | ">")`
 	Operand *astExpressionSum `@@`
 }
 
 type astExpressionSum struct {
-	Call  *astExpressionCall `@@`
-	Terms []*astTerm         `@@*`
+	Call    *astExpressionCall `@@`
+	Factors []*astFactor       `@@*`
+	Terms   []*astTerm         `@@*`
 }
 
 type astTerm struct {
-	Op      string             `@"+"`
+	Op      string             `@("+" | "-")`
+	Operand *astExpressionCall `@@`
+	Factors []*astFactor       `@@*`
+
+	Pos lexer.Position
+}
+
+type astFactor struct {
+	Op      string             `@("*" | "/")`
 	Operand *astExpressionCall `@@`
+
+	Pos lexer.Position
 }
 
 type astExpressionCall struct {
-	Base  *astExpressionBase `@@`
-	Calls []*astMethodCall   `@@*`
+	Base      *astExpressionBase `@@`
+	Calls     []*astMethodCall   `@@*`
+	Propagate bool               `@"?"?`
+	Methods   []*astMethod       `@@*`
+
+	Pos lexer.Position
+}
+
+// astMethod is a call written as `receiver.name(args)`, which is the same as
+// `name(receiver, args)`.
+type astMethod struct {
+	Name      string         `"." @Ident`
+	Call      *astMethodCall `@@`
+	Propagate bool           `@"?"?`
+
+	Pos lexer.Position
 }
 
 type astExpressionBase struct {
 	Variable        *string          `  @Ident`
 	StructArguments []*astExpression `  ("{" @@ ("," @@)+ "}")?`
 	String          *string          `| @String`
-	Tuple           []*astExpression `| "(" @@ ("," @@)+ ")"`
-	Integer         *int64           `| @Int`
+	Tuple           []*astExpression `| "(" @@ ("," @@)* ")"`
+	Float           *float64         `| @("-"? Float)`
+	Integer         *string          `| @("-"? Int)` // parsed once its type is known
 	IsArray         bool             `| @("["`
-	Array           []*astExpression `  (@@ ("," @@)*)? "]")`
+	Array           []*astExpression `  (EOL* @@ ("," EOL* @@)* EOL*)? "]")`
 
 	Pos lexer.Position
 }
@@ -324,6 +554,36 @@ type program struct {
 	Functions          map[string]*astFunction
 	GeneratedFunctions []*generator
 	Types              map[string][]*TypeRep
+	Aliases            map[string]*TypeRep
+	Linear             map[string]bool
+	Destructors        map[string]string
+
+	// Traits by name, the trait that declares each method, and the
+	// implementations of each trait, keyed by the type they're for. Generic
+	// implementations are tried in order for types with none of their own.
+	Traits       map[string]*astTrait
+	TraitMethods map[string]string
+	Impls        map[string]map[string]*astImpl
+	GenericImpls map[string][]*astImpl
+
+	// typeArgs binds the type parameters (or Self) of the signature or
+	// function body being resolved.
+	typeArgs map[string]*Kind
+	// instances holds the names of the generic functions generated so far.
+	instances map[string]bool
+	// usedStructs holds the structs that the remaining functions use, once
+	// unused functions have been pruned.
+	usedStructs map[string]bool
+
+	// Aliases being resolved, with how many structs were being resolved when
+	// they started.
+	resolvingAliases map[string]int
+	// Structs are resolved once, so that recursive structs refer back to
+	// the same Kind. While a struct is being resolved, resolvingStructs
+	// holds how many Boxes deep we were when it started.
+	structKinds      map[string]*Kind
+	resolvingStructs map[string]int
+	boxDepth         int
 }
 
 func (p *program) MustResolveBuiltinType(label string) *Kind {
@@ -334,13 +594,343 @@ func (p *program) MustResolveBuiltinType(label string) *Kind {
 	return kind
 }
 
+// AddDestructor renames a "drop" function after the type it destroys, so that
+// each type can have its own.
+func (p *program) AddDestructor(fun *astFunction) error {
+	if len(fun.Args) != 1 || len(fun.Args[0].Kind.Args) > 0 || fun.Args[0].Kind.Borrowed || len(fun.ReturnKind) > 0 {
+		return fmt.Errorf("drop must take a single owned struct and return nothing")
+	}
+
+	name := fun.Args[0].Kind.Name
+	if _, ok := p.Destructors[name]; ok {
+		return fmt.Errorf("drop already defined for %s", name)
+	}
+	fun.Name = "drop_" + name
+	fun.IsDestructor = true
+	p.Destructors[name] = fun.Name
+	return nil
+}
+
+// AddTrait declares a trait, whose methods must each dispatch on their first
+// argument.
+func (p *program) AddTrait(trait *astTrait) error {
+	if _, ok := p.Traits[trait.Name]; ok {
+		return fmt.Errorf("trait already exists: %s", trait.Name)
+	}
+	for _, method := range trait.Methods {
+		if method.Block != nil || method.IsNative || len(method.TypeParams) > 0 {
+			return fmt.Errorf("method %s of trait %s must be a plain declaration", method.Name, trait.Name)
+		}
+		if len(method.Args) == 0 || method.Args[0].Kind.Name != "Self" {
+			return fmt.Errorf("the first argument of %s must be Self or &Self", method.Name)
+		}
+		if other, ok := p.TraitMethods[method.Name]; ok {
+			return fmt.Errorf("method %s is declared by both %s and %s", method.Name, other, trait.Name)
+		}
+		p.TraitMethods[method.Name] = trait.Name
+	}
+	p.Traits[trait.Name] = trait
+	return nil
+}
+
+// AddImpl renames the methods of impl after its type, so that they can be
+// added to the program like any other function.
+func (p *program) AddImpl(impl *astImpl) error {
+	impl.Functions = map[string]string{}
+	for _, fun := range impl.Methods {
+		if _, ok := impl.Functions[fun.Name]; ok {
+			return fmt.Errorf("%s is implemented twice for %s", fun.Name, impl.Kind.Name)
+		}
+		method := fun.Name
+		if len(impl.TypeParams) > 0 {
+			if impl.Trait == "Drop" {
+				return fmt.Errorf("Drop can't be implemented for %s with type parameters", impl.Kind.Name)
+			}
+			if len(fun.TypeParams) > 0 {
+				return fmt.Errorf("%s for %s can't have type parameters of its own", fun.Name, impl.Kind.Name)
+			}
+			fun.TypeParams = impl.TypeParams
+		}
+		if impl.Trait == "Drop" && method == "drop" {
+			if err := p.AddDestructor(fun); err != nil {
+				return err
+			}
+		} else {
+			fun.Name = method + "_" + mangleTypeRep(impl.Kind)
+		}
+		impl.Functions[method] = fun.Name
+	}
+	return nil
+}
+
+// CheckImpl makes sure that impl implements exactly the methods of its trait,
+// with Self replaced by the type it's for.
+func (p *program) CheckImpl(impl *astImpl) error {
+	trait, ok := p.Traits[impl.Trait]
+	if !ok {
+		return fmt.Errorf("unknown trait %s", impl.Trait)
+	}
+	if len(impl.TypeParams) > 0 {
+		// The signatures are checked for each type it's used for, see
+		// Implementation.
+		if len(impl.Methods) != len(trait.Methods) {
+			return fmt.Errorf("%s for %s must implement %d methods, got %d", trait.Name, impl.Kind.Name, len(trait.Methods), len(impl.Methods))
+		}
+		for _, method := range trait.Methods {
+			if _, ok := impl.Functions[method.Name]; !ok {
+				return fmt.Errorf("%s for %s doesn't implement %s", trait.Name, impl.Kind.Name, method.Name)
+			}
+		}
+		p.GenericImpls[trait.Name] = append(p.GenericImpls[trait.Name], impl)
+		return nil
+	}
+	self, err := p.ResolveType(impl.Kind)
+	if err != nil {
+		return err
+	}
+	owned := *self
+	owned.Borrowed = false
+	if _, ok := p.Impls[trait.Name][owned.String()]; ok {
+		return fmt.Errorf("%s is already implemented for %s", trait.Name, owned)
+	}
+	if len(impl.Methods) != len(trait.Methods) {
+		return fmt.Errorf("%s for %s must implement %d methods, got %d", trait.Name, owned, len(trait.Methods), len(impl.Methods))
+	}
+	if err := p.checkSignatures(trait, impl, &owned, nil); err != nil {
+		return err
+	}
+
+	if p.Impls[trait.Name] == nil {
+		p.Impls[trait.Name] = map[string]*astImpl{}
+	}
+	p.Impls[trait.Name][owned.String()] = impl
+	return nil
+}
+
+// checkSignatures makes sure that each method of impl has the signature that
+// trait gives it, with Self replaced by owned. typeArgs binds the type
+// parameters of a generic impl.
+func (p *program) checkSignatures(trait *astTrait, impl *astImpl, owned *Kind, typeArgs map[string]*Kind) error {
+	for _, method := range trait.Methods {
+		name, ok := impl.Functions[method.Name]
+		if !ok {
+			return fmt.Errorf("%s for %s doesn't implement %s", trait.Name, owned, method.Name)
+		}
+		restore := p.BindTypeArgs(map[string]*Kind{"Self": owned})
+		expected, err := p.resolveSignature(method)
+		restore()
+		if err != nil {
+			return err
+		}
+		restore = p.BindTypeArgs(typeArgs)
+		actual, err := p.resolveSignature(p.Functions[name])
+		restore()
+		if err != nil {
+			return err
+		}
+		if len(actual) != len(expected) {
+			return fmt.Errorf("%s for %s: %s should take %d arguments and return %d values", trait.Name, owned, method.Name, len(method.Args), len(method.ReturnKind))
+		}
+		for i := range expected {
+			if err := actual[i].IsEquivalent(*expected[i]); err != nil {
+				return fmt.Errorf("%s for %s: %s has the wrong signature (%v)", trait.Name, owned, method.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveSignature resolves the kinds of the arguments of fun, followed by
+// its results.
+func (p *program) resolveSignature(fun *astFunction) ([]*Kind, error) {
+	reps := []*TypeRep{}
+	for _, arg := range fun.Args {
+		reps = append(reps, arg.Kind)
+	}
+	reps = append(reps, fun.ReturnKind...)
+
+	kinds := []*Kind{}
+	for _, rep := range reps {
+		kind, err := p.ResolveType(rep)
+		if err != nil {
+			return nil, err
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+// Implements reports whether values of the given kind implement a trait.
+// Anything that can be dropped implicitly counts as implementing Drop.
+func (p *program) Implements(kind *Kind, trait string) error {
+	if _, ok := p.Traits[trait]; !ok {
+		return fmt.Errorf("unknown trait %s", trait)
+	}
+	owned := *kind
+	owned.Borrowed = false
+	if _, ok := p.Impls[trait][owned.String()]; ok {
+		return nil
+	}
+	if impl, _, err := p.genericImpl(trait, &owned); impl != nil || err != nil {
+		return err
+	}
+	if trait == "Drop" && !owned.Linear && (!owned.NeedsToBeDeleted() || owned.CanBeImplicitlyDeleted()) {
+		return nil
+	}
+	return fmt.Errorf("%s doesn't implement %s", owned, trait)
+}
+
+// Implementation finds the function that implements a trait method for
+// values of the given kind.
+func (p *program) Implementation(method string, kind *Kind) (string, error) {
+	trait := p.TraitMethods[method]
+	owned := *kind
+	owned.Borrowed = false
+	if impl, ok := p.Impls[trait][owned.String()]; ok {
+		return impl.Functions[method], nil
+	}
+
+	impl, typeArgs, err := p.genericImpl(trait, &owned)
+	if err != nil {
+		return "", err
+	}
+	if impl == nil {
+		return "", fmt.Errorf("%s doesn't implement %s, so it has no method %s", owned, trait, method)
+	}
+	if err := p.checkSignatures(p.Traits[trait], impl, &owned, typeArgs); err != nil {
+		return "", err
+	}
+	// The method is generic, so the call instantiates it.
+	return impl.Functions[method], nil
+}
+
+// genericImpl finds the first generic implementation of a trait that covers
+// the given kind, and the type arguments that make it do so. It returns an
+// error if one covers the kind but its type arguments don't meet their
+// bounds.
+func (p *program) genericImpl(trait string, owned *Kind) (*astImpl, map[string]*Kind, error) {
+	for _, impl := range p.GenericImpls[trait] {
+		// Every method has the impl's type parameters, so any of them can
+		// match up the type.
+		typeArgs := map[string]*Kind{}
+		if err := impl.Methods[0].unify(impl.Kind, owned, typeArgs); err != nil || len(typeArgs) < len(impl.TypeParams) {
+			continue
+		}
+		restore := p.BindTypeArgs(typeArgs)
+		kind, err := p.ResolveType(impl.Kind)
+		restore()
+		if err != nil || kind.IsEquivalent(*owned) != nil {
+			continue
+		}
+
+		for _, param := range impl.TypeParams {
+			for _, bound := range param.Bounds {
+				if err := p.Implements(typeArgs[param.Name], bound); err != nil {
+					return nil, nil, fmt.Errorf("%s doesn't implement %s, since %s = %s: %w", owned, trait, param.Name, typeArgs[param.Name], err)
+				}
+			}
+		}
+		return impl, typeArgs, nil
+	}
+	return nil, nil, nil
+}
+
+// BindTypeArgs makes type names resolve to the given kinds, until the
+// returned function restores the previous bindings.
+func (p *program) BindTypeArgs(args map[string]*Kind) func() {
+	previous := p.typeArgs
+	p.typeArgs = args
+	return func() { p.typeArgs = previous }
+}
+
+// mangleTypeRep turns a type into something that can be part of a name.
+func mangleTypeRep(t *TypeRep) string {
+	name := t.Name
+	for _, arg := range t.Args {
+		name += "_" + mangleTypeRep(arg)
+	}
+	return name
+}
+
+// mangleKind is like mangleTypeRep, for resolved types.
+func mangleKind(k *Kind) string {
+	name := k.Label
+	if k.Borrowed {
+		name = "ref_" + name
+	}
+	if k.IsStruct() {
+		return name
+	}
+	for _, arg := range k.TupleOrUnionArgs {
+		name += "_" + mangleKind(arg)
+	}
+	return name
+}
+
+// HasType reports whether name is already declared as a struct or an alias.
+func (p *program) HasType(name string) bool {
+	_, isStruct := p.Types[name]
+	_, isAlias := p.Aliases[name]
+	return isStruct || isAlias
+}
+
 func (p *program) ResolveType(t *TypeRep) (*Kind, error) {
 	var (
 		family Family
 		args   []*Kind
 	)
 
-	if t.Name == "Union" || t.Name == "Tuple" || t.Name == "Array" {
+	if bound, ok := p.typeArgs[t.Name]; ok {
+		if len(t.Args) > 0 {
+			return nil, fmt.Errorf("type parameter %s doesn't take arguments", t.Name)
+		}
+		kind := *bound
+		kind.Borrowed = kind.Borrowed || t.Borrowed
+		return &kind, nil
+	}
+
+	if target, ok := p.Aliases[t.Name]; ok {
+		// Aliases are transparent: they resolve to exactly the aliased type.
+		if len(t.Args) > 0 {
+			return nil, fmt.Errorf("type alias %s doesn't take arguments", t.Name)
+		}
+		// Aliases may only refer to themselves through a (boxed) struct.
+		structs, resolving := p.resolvingAliases[t.Name]
+		if resolving && structs == len(p.resolvingStructs) {
+			return nil, fmt.Errorf("type alias %s refers to itself", t.Name)
+		}
+		p.resolvingAliases[t.Name] = len(p.resolvingStructs)
+		resolved, err := p.ResolveType(target)
+		if resolving {
+			p.resolvingAliases[t.Name] = structs
+		} else {
+			delete(p.resolvingAliases, t.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		kind := *resolved
+		kind.Borrowed = kind.Borrowed || t.Borrowed
+		return &kind, nil
+	}
+
+	if t.Name == "Option" {
+		// Option[T] is a union of T and None.
+		if len(t.Args) != 1 {
+			return nil, fmt.Errorf("Option takes exactly one argument, got %d", len(t.Args))
+		}
+		value, err := p.ResolveType(t.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		none, err := p.ResolveType(&TypeRep{false, "None", nil})
+		if err != nil {
+			return nil, err
+		}
+		return &Kind{Borrowed: t.Borrowed, Family: FamilyUnion, TupleOrUnionArgs: []*Kind{value, none}, Label: "Option"}, nil
+	}
+
+	if t.Name == "Union" || t.Name == "Tuple" || t.Name == "Array" || t.Name == "Box" || t.Name == "Shared" {
 		// Generic type (has type arguments)
 		if t.Name == "Union" {
 			family = FamilyUnion
@@ -348,6 +938,18 @@ func (p *program) ResolveType(t *TypeRep) (*Kind, error) {
 			family = FamilyTuple
 		} else if t.Name == "Array" {
 			family = FamilyArray
+		} else if t.Name == "Box" {
+			if len(t.Args) != 1 {
+				return nil, fmt.Errorf("Box takes exactly one argument, got %d", len(t.Args))
+			}
+			family = FamilyBox
+			p.boxDepth += 1
+			defer func() { p.boxDepth -= 1 }()
+		} else if t.Name == "Shared" {
+			if len(t.Args) != 1 {
+				return nil, fmt.Errorf("Shared takes exactly one argument, got %d", len(t.Args))
+			}
+			family = FamilyShared
 		}
 
 		for _, arg := range t.Args {
@@ -369,17 +971,14 @@ func (p *program) ResolveType(t *TypeRep) (*Kind, error) {
 			return nil, fmt.Errorf("unknown type %s", t.Name)
 		}
 
-		// If the type has fields, fill them in as though they were type arguments
-		for _, field := range fields {
-			resolved, err := p.ResolveType(field)
-			if err != nil {
-				return nil, err
-			}
-			args = append(args, resolved)
-		}
-
 		if len(fields) > 0 {
-			family = FamilyTuple
+			kind, err := p.resolveStruct(t.Name, fields)
+			if err != nil || !t.Borrowed {
+				return kind, err
+			}
+			borrowed := *kind
+			borrowed.Borrowed = true
+			return &borrowed, nil
 		} else {
 			fam, err := CaptureFamily(t.Name)
 			if err != nil {
@@ -394,13 +993,48 @@ func (p *program) ResolveType(t *TypeRep) (*Kind, error) {
 		Family:           family,
 		TupleOrUnionArgs: args,
 		Label:            t.Name,
+		Linear:           p.Linear[t.Name],
+		Destructor:       p.Destructors[t.Name],
 	}, nil
 }
 
+// resolveStruct fills in the fields of a struct as though they were type
+// arguments. A struct may only contain itself through a Box.
+func (p *program) resolveStruct(name string, fields []*TypeRep) (*Kind, error) {
+	if kind, ok := p.structKinds[name]; ok {
+		if depth, ok := p.resolvingStructs[name]; ok && p.boxDepth <= depth {
+			return nil, fmt.Errorf("struct %[1]s contains itself; use Box[%[1]s] instead", name)
+		}
+		return kind, nil
+	}
+
+	kind := &Kind{
+		Family:     FamilyTuple,
+		Label:      name,
+		Linear:     p.Linear[name],
+		Destructor: p.Destructors[name],
+	}
+	p.structKinds[name] = kind
+	p.resolvingStructs[name] = p.boxDepth
+	defer delete(p.resolvingStructs, name)
+
+	for _, field := range fields {
+		resolved, err := p.ResolveType(field)
+		if err != nil {
+			delete(p.structKinds, name)
+			return nil, err
+		}
+		kind.TupleOrUnionArgs = append(kind.TupleOrUnionArgs, resolved)
+	}
+	return kind, nil
+}
+
 var ufLexer = stateful.MustSimple([]stateful.Rule{
 	{`Ident`, `[a-zA-Z][a-zA-Z_\d]*`, nil},
 	{`String`, `"(?:\\.|[^"])*"`, nil},
+	{`Float`, `\d+\.\d+`, nil},
 	{`Int`, `\d+`, nil},
+	{`Operator`, `>=|<=|==|!=`, nil},
 	{`EOL`, `[\r\n]`, nil},
 	{"comment", `//[^\n]*`, nil},
 	{"Punct", `[-[!@#$%^&*()+_={}\|:;"'<,>.?/]|]`, nil},
@@ -412,8 +1046,43 @@ var parser = participle.MustBuild(
 	participle.Lexer(ufLexer),
 	participle.Unquote("String"))
 
+// Options controls what Compile produces besides C code.
+type Options struct {
+	// EmitIR adds a <main>.ir file with the IR after each pass.
+	EmitIR bool
+	// Stats, if set, receives the size of each function's state.
+	Stats io.Writer
+	// CriticalPath, if set, receives an estimate of how long the program
+	// takes, and why (see FormatCriticalPath).
+	CriticalPath io.Writer
+	// SourceDir and OutputDir are where the .ht files are read from and the
+	// C files are written to, as seen by the C compiler. The #line
+	// directives in the C code refer to them.
+	SourceDir, OutputDir string
+}
+
 func Parse(main string, sources map[string]string) (map[string]string, error) {
-	program := &program{map[string]*astFunction{}, []*generator{}, map[string][]*TypeRep{}}
+	return Compile(main, sources, Options{})
+}
+
+func Compile(main string, sources map[string]string, options Options) (map[string]string, error) {
+	program := &program{
+		Functions:          map[string]*astFunction{},
+		GeneratedFunctions: []*generator{},
+		Types:              map[string][]*TypeRep{},
+		Aliases:            map[string]*TypeRep{},
+		Linear:             map[string]bool{},
+		Destructors:        map[string]string{},
+		resolvingAliases:   map[string]int{},
+		structKinds:        map[string]*Kind{},
+		resolvingStructs:   map[string]int{},
+		Traits:             map[string]*astTrait{},
+		TraitMethods:       map[string]string{},
+		Impls:              map[string]map[string]*astImpl{},
+		GenericImpls:       map[string][]*astImpl{},
+		instances:          map[string]bool{},
+	}
+	impls := []*astImpl{}
 
 	queue := []string{main}
 	nextQueue := []string{}
@@ -436,17 +1105,42 @@ func Parse(main string, sources map[string]string) (map[string]string, error) {
 			}
 
 			for _, defn := range t.Definitions {
-				if fun := defn.Function; fun != nil {
-					if _, ok := program.Functions[fun.Name]; ok {
-						return nil, fmt.Errorf("function already exists: %s", fun.Name)
+				if trait := defn.Trait; trait != nil {
+					if err := program.AddTrait(trait); err != nil {
+						return nil, err
 					}
-					program.Functions[fun.Name] = fun
+				} else if defn.Function != nil || defn.Impl != nil {
+					functions := []*astFunction{defn.Function}
+					if impl := defn.Impl; impl != nil {
+						if err := program.AddImpl(impl); err != nil {
+							return nil, err
+						}
+						impls = append(impls, impl)
+						functions = impl.Methods
+					}
+					for _, fun := range functions {
+						if fun.Name == "drop" {
+							if err := program.AddDestructor(fun); err != nil {
+								return nil, err
+							}
+						}
+						if _, ok := program.Functions[fun.Name]; ok {
+							return nil, fmt.Errorf("function already exists: %s", fun.Name)
+						}
+						program.Functions[fun.Name] = fun
+					}
+				} else if alias := defn.Alias; alias != nil {
+					if program.HasType(alias.Name) {
+						return nil, fmt.Errorf("type already exists: %s", alias.Name)
+					}
+					program.Aliases[alias.Name] = alias.Kind
 				} else {
 					strct := defn.Struct
-					if _, ok := program.Types[strct.Name]; ok {
+					if program.HasType(strct.Name) {
 						return nil, fmt.Errorf("type already exists: %s", strct.Name)
 					}
 					program.Types[strct.Name] = strct.Fields
+					program.Linear[strct.Name] = strct.IsLinear
 				}
 			}
 		}
@@ -457,17 +1151,126 @@ func Parse(main string, sources map[string]string) (map[string]string, error) {
 		return nil, fmt.Errorf("no main function defined in %s", main)
 	}
 
-	for _, fun := range program.Functions {
+	for name := range program.Destructors {
+		if _, ok := program.Types[name]; !ok {
+			return nil, fmt.Errorf("drop defined for unknown struct %s", name)
+		}
+		if program.Linear[name] {
+			return nil, fmt.Errorf("linear struct %s cannot have a drop function", name)
+		}
+	}
+
+	for _, impl := range impls {
+		if err := program.CheckImpl(impl); err != nil {
+			return nil, err
+		}
+	}
+	for method := range program.TraitMethods {
+		if _, ok := program.Functions[method]; ok {
+			return nil, fmt.Errorf("function %s has the same name as a trait method", method)
+		}
+	}
+
+	// Functions are generated in order of name, so that compiling the same
+	// program twice gives the same output.
+	functionNames := []string{}
+	for name := range program.Functions {
+		functionNames = append(functionNames, name)
+	}
+	sort.Strings(functionNames)
+	for _, name := range functionNames {
+		fun := program.Functions[name]
+		if len(fun.TypeParams) > 0 {
+			// Generated for each set of type arguments it's called with.
+			continue
+		}
 		if err := fun.Generate(program); err != nil {
 			return nil, err
 		}
 	}
 
+	ir := strings.Builder{}
+	if options.EmitIR {
+		if err := program.DumpIR(&ir, "generate"); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.CriticalPath != nil {
+		program.FormatCriticalPath(options.CriticalPath)
+	}
+
+	frames := FrameSizes(program.GeneratedFunctions)
+	program.InlineFunctions()
+	if options.EmitIR {
+		if err := program.DumpIR(&ir, "inline"); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, defin := range program.GeneratedFunctions {
+		defin.RemoveDeadStatements()
+	}
+	program.PruneFunctions()
+	if options.EmitIR {
+		if err := program.DumpIR(&ir, "remove dead code"); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, defin := range program.GeneratedFunctions {
+		defin.ShareSlots()
+	}
+	if options.EmitIR {
+		if err := program.DumpIR(&ir, "share slots"); err != nil {
+			return nil, err
+		}
+		if err := program.ReloadIR(); err != nil {
+			return nil, err
+		}
+	}
+	if options.Stats != nil {
+		FormatFrameStats(frames, program.GeneratedFunctions, options.Stats)
+	}
+
+	// Every struct that can be dropped gets a function to free it.
+	structNames := []string{}
+	for name, fields := range program.Types {
+		if len(fields) > 0 {
+			structNames = append(structNames, name)
+		}
+	}
+	sort.Strings(structNames)
+
+	droppableStructs := []*Kind{}
+	for _, name := range structNames {
+		kind, err := program.ResolveType(&TypeRep{false, name, nil})
+		if err != nil {
+			return nil, err
+		}
+		if !program.usedStructs[name] {
+			continue
+		}
+		structural := *kind
+		structural.Destructor = ""
+		if structural.CanBeImplicitlyDeleted() {
+			droppableStructs = append(droppableStructs, kind)
+		}
+	}
+
 	outputFiles := map[string]string{}
+	if options.EmitIR {
+		outputFiles[fmt.Sprintf("%s.ir", main)] = ir.String()
+	}
 
 	result := strings.Builder{}
 	fmt.Fprintf(&result, "#include <stdbool.h>\n")
 	fmt.Fprintf(&result, "#include \"../builtins.h\"\n")
+	for _, kind := range droppableStructs {
+		for _, header := range freeStructHeaders(kind) {
+			fmt.Fprintf(&result, "%s;\n", header)
+		}
+	}
 	for _, defin := range program.GeneratedFunctions {
 		defin.TypeDefinition(&result)
 	}
@@ -480,14 +1283,18 @@ func Parse(main string, sources map[string]string) (map[string]string, error) {
 	fmt.Fprintf(&result, "#include <assert.h>\n")
 	fmt.Fprintf(&result, "#include <string.h>\n")
 	fmt.Fprintf(&result, "#include <stdint.h>\n")
+	for _, kind := range droppableStructs {
+		formatFreeStructInto(kind, &result)
+	}
 	for _, defin := range program.GeneratedFunctions {
-		defin.FormatInto(&result)
+		defin.FormatInto(&result, options.SourceDir)
 		if defin.Name == "main" {
 			if err := defin.FormatMainInto(&result); err != nil {
 				return nil, err
 			}
 		}
 	}
-	outputFiles[fmt.Sprintf("%s.c", main)] = result.String()
+	cFile := fmt.Sprintf("%s.c", main)
+	outputFiles[cFile] = setLineDirectives(result.String(), joinPath(options.OutputDir, cFile))
 	return outputFiles, nil
 }
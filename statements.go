@@ -17,6 +17,8 @@ package unique_effect
 import (
 	"fmt"
 	"io"
+	"math"
+	"strconv"
 	"strings"
 )
 
@@ -29,18 +31,145 @@ type statementWithCancel interface {
 	GenerateCancel(*generator, io.Writer)
 }
 
+// statementWithGuards can wait on more than its dependencies being ready.
+// GuardDeps lists the registers and conditions that the guards read.
+type statementWithGuards interface {
+	Guards(*generator) []string
+	GuardDeps() ([]register, []condition)
+}
+
 func freeGarbage(gen *generator, garbage map[register]*Kind, w io.Writer) {
-	for reg, kind := range garbage {
-		fmt.Fprintf(w, "        if (%s.ready) { // %s\n", gen.Reg(reg), kind)
-		// if kind.Family == FamilyArray {
-		// 	fmt.Fprintf(w, "        struct unique_effect_array *ary = (struct unique_effect_array*)%s.value;\n", gen.Reg(reg))
-		// 	fmt.Fprintf(w, "        for (int i = 0; i < ary->length; i++) { free(ary->elements[i]); }\n")
-		// }
-		fmt.Fprintf(w, "          free(%[1]s.value); // %[2]s\n", gen.Reg(reg), kind)
+	for _, reg := range releasedRegisters(nil, garbage) {
+		kind := garbage[reg]
+		fmt.Fprintf(w, "        if (%s) { // %s\n", gen.Ready(reg), kind)
+		freeValue(fmt.Sprintf("%s.value", gen.Reg(reg)), kind, "          ", w)
 		fmt.Fprintf(w, "        }\n")
 	}
 }
 
+// freeValue releases everything owned by the value in expr: each element or
+// field, then the value itself. Kinds with a destructor are handed off to it.
+func freeValue(expr string, kind *Kind, indent string, w io.Writer) {
+	freeValueLater(expr, kind, indent, "", w)
+}
+
+// freeValueLater is freeValue, except that structs are added to pending (a
+// struct unique_effect_free_list *) to be freed later, unless pending is "".
+// That way a long list is freed one cell at a time rather than by recursion.
+func freeValueLater(expr string, kind *Kind, indent, pending string, w io.Writer) {
+	if !kind.NeedsToBeDeleted() {
+		return
+	}
+
+	if kind.Destructor != "" {
+		fmt.Fprintf(w, "%s{\n", indent)
+		fmt.Fprintf(w, "%s  struct unique_effect_%[2]s_state *drop = calloc(1, sizeof(struct unique_effect_%[2]s_state));\n", indent, kind.Destructor)
+		fmt.Fprintf(w, "%s  drop->r[0] = (future_t){.value = %s, .ready = true};\n", indent, expr)
+		fmt.Fprintf(w, "%s  unique_effect_runtime_schedule(rt, (closure_t){.state = drop, .func = &unique_effect_%s});\n", indent, kind.Destructor)
+		fmt.Fprintf(w, "%s}\n", indent)
+		return
+	}
+
+	if kind.IsStruct() {
+		if pending != "" {
+			fmt.Fprintf(w, "%sunique_effect_free_later(%s, &%s, %s);\n", indent, pending, freeFieldsName(kind), expr)
+		} else {
+			fmt.Fprintf(w, "%s%s(rt, %s);\n", indent, freeStructName(kind), expr)
+		}
+		return
+	}
+
+	if kind.Family == FamilyShared {
+		// Only the last reference frees the value.
+		shared := fmt.Sprintf("((struct unique_effect_shared *)%s)", expr)
+		fmt.Fprintf(w, "%sif (atomic_fetch_sub(&%s->references, 1) == 1) {\n", indent, shared)
+		freeValueLater(shared+"->value", kind.TupleOrUnionArgs[0], indent+"  ", pending, w)
+		fmt.Fprintf(w, "%s  free(%s); // %s\n", indent, expr, kind)
+		fmt.Fprintf(w, "%s}\n", indent)
+		return
+	}
+
+	switch kind.Family {
+	case FamilyArray:
+		if element := kind.TupleOrUnionArgs[0]; element.NeedsToBeDeleted() {
+			index := fmt.Sprintf("i%d", len(indent))
+			ary := fmt.Sprintf("((struct unique_effect_array *)%s)", expr)
+			fmt.Fprintf(w, "%sfor (int %[2]s = 0; %[2]s < %[3]s->length; %[2]s++) {\n", indent, index, ary)
+			freeValueLater(fmt.Sprintf("%s->elements[%s]", ary, index), element, indent+"  ", pending, w)
+			fmt.Fprintf(w, "%s}\n", indent)
+		}
+	case FamilyBox:
+		freeValueLater(fmt.Sprintf("((val_t *)%s)[0]", expr), kind.TupleOrUnionArgs[0], indent, pending, w)
+	case FamilyTuple:
+		for i, field := range kind.TupleOrUnionArgs {
+			freeValueLater(fmt.Sprintf("((val_t *)%s)[%d]", expr, i), field, indent, pending, w)
+		}
+	case FamilyUnion:
+		for i, option := range kind.TupleOrUnionArgs {
+			if option.NeedsToBeDeleted() {
+				fmt.Fprintf(w, "%sif (((val_t *)%s)[0] == (val_t)%d) {\n", indent, expr, i)
+				freeValueLater(fmt.Sprintf("((val_t *)%s)[1]", expr), option, indent+"  ", pending, w)
+				fmt.Fprintf(w, "%s}\n", indent)
+			}
+		}
+	}
+	fmt.Fprintf(w, "%sfree(%s); // %s\n", indent, expr, kind)
+}
+
+// Generated code names everything that comes from the program
+// unique_effect_..., so these names can't collide with a user's function.
+func freeStructName(kind *Kind) string {
+	return fmt.Sprintf("free_struct_%s", kind.Label)
+}
+
+func freeFieldsName(kind *Kind) string {
+	return fmt.Sprintf("free_fields_%s", kind.Label)
+}
+
+func freeStructHeaders(kind *Kind) []string {
+	return []string{
+		fmt.Sprintf("void %s(struct unique_effect_runtime *rt, val_t value)", freeStructName(kind)),
+		fmt.Sprintf("void %s(struct unique_effect_runtime *rt, struct unique_effect_free_list *pending, val_t value)", freeFieldsName(kind)),
+	}
+}
+
+// formatFreeStructInto defines the functions that free a struct: one that
+// frees it field by field, leaving any structs inside it on a list, and one
+// that keeps going until the list is empty.
+func formatFreeStructInto(kind *Kind, w io.Writer) {
+	headers := freeStructHeaders(kind)
+	fmt.Fprintf(w, "%s {\n", headers[0])
+	fmt.Fprintf(w, "  struct unique_effect_free_list pending = {0};\n")
+	fmt.Fprintf(w, "  unique_effect_free_later(&pending, &%s, value);\n", freeFieldsName(kind))
+	fmt.Fprintf(w, "  unique_effect_free_all(rt, &pending);\n")
+	fmt.Fprintf(w, "}\n")
+
+	fmt.Fprintf(w, "%s {\n", headers[1])
+	for i, field := range kind.TupleOrUnionArgs {
+		freeValueLater(fmt.Sprintf("((val_t *)value)[%d]", i), field, "  ", "pending", w)
+	}
+	fmt.Fprintf(w, "  free(value);\n")
+	fmt.Fprintf(w, "}\n")
+}
+
+// genDrop frees a value that is no longer needed, then marks Done.
+type genDrop struct {
+	Input register
+	Kind  *Kind
+	Done  register
+}
+
+func (g *genDrop) Generate(gen *generator) string {
+	b := strings.Builder{}
+	freeValue(fmt.Sprintf("%s.value", gen.Reg(g.Input)), g.Kind, "    ", &b)
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Done))
+	return b.String()
+}
+
+func (g *genDrop) Deps() ([]register, []register) {
+	return []register{g.Input}, []register{g.Done}
+}
+
 type genRenameRegister struct {
 	Source, Destination register
 }
@@ -72,7 +201,12 @@ type genIntegerLiteral struct {
 }
 
 func (g *genIntegerLiteral) Generate(gen *generator) string {
-	return fmt.Sprintf("    %s = (future_t){.value = (void*)(intptr_t)%d, .ready = true};\n", gen.Reg(g.Target), g.Value)
+	value := fmt.Sprintf("%d", g.Value)
+	if g.Value == math.MinInt64 {
+		// -9223372036854775808 is too big for C, before it's negated.
+		value = "INT64_MIN"
+	}
+	return fmt.Sprintf("    %s = (future_t){.value = (void*)(intptr_t)%s, .ready = true};\n", gen.Reg(g.Target), value)
 }
 
 func (g *genIntegerLiteral) Deps() ([]register, []register) {
@@ -109,39 +243,74 @@ type genCallAsyncFunction struct {
 	Args      []register
 	Result    []register
 	ChildCall childCall
+	// Position is where the call was made, which native functions such as
+	// sleep put in the trace.
+	Position string
 }
 
-func (g *genCallAsyncFunction) Generate(gen *generator) string {
-	var result strings.Builder
-	fmt.Fprintf(&result, "    if (sp->call_%d == NULL) {\n", g.ChildCall)
-	fmt.Fprintf(&result, "      sp->call_%d = calloc(1, sizeof(struct unique_effect_%s_state));\n",
+// start allocates the state of the called function, the first time that any
+// of its arguments is ready (or that it's cancelled).
+func (g *genCallAsyncFunction) start(gen *generator, w io.Writer) {
+	fmt.Fprintf(w, "      sp->call_%d = calloc(1, sizeof(struct unique_effect_%s_state));\n",
 		g.ChildCall, g.Name)
 
 	for i, ret := range g.Result {
-		fmt.Fprintf(&result, "      sp->call_%d->result[%d] = &%s;\n", g.ChildCall, i, gen.Reg(ret))
+		fmt.Fprintf(w, "      sp->call_%d->result[%d] = &%s;\n", g.ChildCall, i, gen.Reg(ret))
+	}
+
+	fmt.Fprintf(w, "      sp->call_%d->caller.func = &unique_effect_%s;\n", g.ChildCall, gen.Name)
+	fmt.Fprintf(w, "      sp->call_%d->caller.state = sp;\n", g.ChildCall)
+	fmt.Fprintf(w, "      sp->call_%d->conditions[0] = false;\n", g.ChildCall)
+	fmt.Fprintf(w, "      UNIQUE_EFFECT_TRACE_CALLED_FROM(sp->call_%d, %q);\n", g.ChildCall, g.Position)
+	if len(g.Result) > 0 {
+		fmt.Fprintf(w, "      sp->inflight[sp->inflight_size++] = %d;\n", g.ChildCall)
 	}
+}
 
-	fmt.Fprintf(&result, "      sp->call_%d->caller.func = &unique_effect_%s;\n", g.ChildCall, gen.Name)
-	fmt.Fprintf(&result, "      sp->call_%d->caller.state = sp;\n", g.ChildCall)
-	fmt.Fprintf(&result, "      sp->call_%d->conditions[0] = false;\n", g.ChildCall)
+func (g *genCallAsyncFunction) Generate(gen *generator) string {
+	var result strings.Builder
+	anyReady := []string{}
+	for _, arg := range g.Args {
+		anyReady = append(anyReady, gen.Ready(arg))
+	}
+	if len(anyReady) == 0 {
+		fmt.Fprintf(&result, "    if (sp->call_%d == NULL) {\n", g.ChildCall)
+	} else {
+		fmt.Fprintf(&result, "    if (sp->call_%d == NULL && (%s)) {\n", g.ChildCall, strings.Join(anyReady, " || "))
+	}
+	g.start(gen, &result)
 	fmt.Fprintf(&result, "    }\n")
 
+	fmt.Fprintf(&result, "    if (sp->call_%d != NULL) {\n", g.ChildCall)
 	for i, arg := range g.Args {
-		fmt.Fprintf(&result, "    sp->call_%d->r[%d].value = %s.value;\n", g.ChildCall, i, gen.Reg(arg))
-		fmt.Fprintf(&result, "    sp->call_%d->r[%d].ready = %s.ready;\n", g.ChildCall, i, gen.Reg(arg))
-		fmt.Fprintf(&result, "    %s.cancelled = sp->call_%d->r[%d].cancelled;\n", gen.Reg(arg), g.ChildCall, i)
+		fmt.Fprintf(&result, "      sp->call_%d->r[%d].value = %s.value;\n", g.ChildCall, i, gen.Reg(arg))
+		fmt.Fprintf(&result, "      sp->call_%d->r[%d].ready = %s;\n", g.ChildCall, i, gen.Ready(arg))
 	}
-	fmt.Fprintf(&result, "    unique_effect_runtime_schedule(rt, (closure_t){.state = sp->call_%d, .func = &unique_effect_%s});\n", g.ChildCall, g.Name)
+	g.generatePoll(gen, &result)
+	fmt.Fprintf(&result, "      unique_effect_runtime_schedule(rt, (closure_t){.state = sp->call_%d, .func = &unique_effect_%s});\n", g.ChildCall, g.Name)
+	fmt.Fprintf(&result, "    }\n")
 
 	return result.String()
 }
 
+// generatePoll picks up arguments that the called function has cancelled.
+// It runs each time the caller is woken up, while the call is in flight.
+func (g *genCallAsyncFunction) generatePoll(gen *generator, w io.Writer) {
+	for i, arg := range g.Args {
+		fmt.Fprintf(w, "      %s.cancelled = sp->call_%d->r[%d].cancelled;\n", gen.Reg(arg), g.ChildCall, i)
+		fmt.Fprintf(w, "      sp->cancelling |= %s.cancelled;\n", gen.Reg(arg))
+	}
+}
+
 func (g *genCallAsyncFunction) Deps() ([]register, []register) {
 	// Async functions track dependencies internally.
 	return nil, g.Result
 }
 
 func (g *genCallAsyncFunction) GenerateCancel(gen *generator, w io.Writer) {
+	fmt.Fprintf(w, "    if (sp->call_%d == NULL) {\n", g.ChildCall)
+	g.start(gen, w)
+	fmt.Fprintf(w, "    }\n")
 	for _, arg := range g.Args {
 		fmt.Fprintf(w, "    %s.cancelled = true;\n", gen.Reg(arg))
 	}
@@ -154,11 +323,46 @@ type genRestartLoop struct {
 	Garbage   map[register]*Kind
 }
 
+// Generate starts the next iteration of a loop. When this iteration is over
+// by the time it restarts (every value for the next one is ready, and no call
+// could still write to this state), the state is reset and reused. Otherwise
+// the next iteration gets a state of its own, so that the two can overlap, and
+// this one is freed once it has handed over every value.
 func (g *genRestartLoop) Generate(gen *generator) string {
 	var result strings.Builder
+	allReady := []string{}
+	for _, arg := range g.Args {
+		allReady = append(allReady, gen.Ready(arg))
+	}
+	ready := strings.Join(allReady, " && ")
+	if len(allReady) == 0 {
+		ready = "true"
+	}
+
 	fmt.Fprintf(&result, "    if (!sp->call_%d_done) {\n", g.ChildCall)
+	fmt.Fprintf(&result, "      UNIQUE_EFFECT_STAT(loop_iterations, sp->call_%d == NULL);\n", g.ChildCall)
+	fmt.Fprintf(&result, "      if (sp->call_%d == NULL && sp->inflight_size == 0 && %s) {\n", g.ChildCall, ready)
+	if len(g.Args) > 0 {
+		values := []string{}
+		for _, arg := range g.Args {
+			values = append(values, gen.Reg(arg))
+		}
+		fmt.Fprintf(&result, "        future_t next[%d] = {%s};\n", len(g.Args), strings.Join(values, ", "))
+	}
+	freeGarbage(gen, g.Garbage, &result)
+	fmt.Fprintf(&result, "        memset(&sp->r, '\\0', sizeof(sp->r));\n")
+	for i := range g.Args {
+		fmt.Fprintf(&result, "        sp->r[%d] = next[%d];\n", i, i)
+	}
+	fmt.Fprintf(&result, "        sp->conditions[0] = false;\n")
+	fmt.Fprintf(&result, "        %s", gen.Trace('e', "false"))
+	fmt.Fprintf(&result, "        %s", gen.Trace('E', "false"))
+	fmt.Fprintf(&result, "        goto start;\n")
+	fmt.Fprintf(&result, "      }\n")
+
 	fmt.Fprintf(&result, "      if (sp->call_%d == NULL) {\n", g.ChildCall)
-	fmt.Fprintf(&result, "        sp->call_%d = malloc(sizeof(struct unique_effect_%s_state));\n",
+	fmt.Fprintf(&result, "        UNIQUE_EFFECT_STAT(loop_frames, 1);\n")
+	fmt.Fprintf(&result, "        sp->call_%d = calloc(1, sizeof(struct unique_effect_%s_state));\n",
 		g.ChildCall, gen.Name)
 	for i := range gen.ReturnKind {
 		fmt.Fprintf(&result, "        sp->call_%d->result[%d] = sp->result[%d];\n", g.ChildCall, i, i)
@@ -174,14 +378,12 @@ func (g *genRestartLoop) Generate(gen *generator) string {
 
 	fmt.Fprintf(&result, "      unique_effect_runtime_schedule(rt, (closure_t){.state = sp->call_%d, .func = &unique_effect_%s});\n", g.ChildCall, gen.Name)
 
-	cArgs := []string{}
-	for _, arg := range g.Args {
-		cArgs = append(cArgs, fmt.Sprintf("%s.ready", gen.Reg(arg)))
-	}
-	fmt.Fprintf(&result, "      if (%s) {\n", strings.Join(cArgs, " && "))
+	fmt.Fprintf(&result, "      if (%s) {\n", ready)
 	fmt.Fprintf(&result, "        sp->call_%d_done = true;\n", g.ChildCall)
 
 	freeGarbage(gen, g.Garbage, &result)
+	fmt.Fprintf(&result, "        %s", gen.Trace('e', "sp->cancelling"))
+	fmt.Fprintf(&result, "        %s", gen.Trace('E', "sp->cancelling"))
 	fmt.Fprintf(&result, "        free(sp);\n")
 	fmt.Fprintf(&result, "        return;\n")
 	fmt.Fprintf(&result, "      }\n")
@@ -215,11 +417,17 @@ func (g *genReturn) Generate(gen *generator) string {
 	for i, reg := range g.ReturnValue {
 		fmt.Fprintf(&b, "    *sp->result[%d] = %s;\n", i, gen.Reg(reg))
 	}
-	fmt.Fprintf(&b, "    unique_effect_runtime_schedule(rt, sp->caller);\n")
 
+	// Destructors are scheduled before resuming the caller.
 	freeGarbage(gen, g.Garbage, &b)
 
+	if !gen.IsDestructor {
+		fmt.Fprintf(&b, "    unique_effect_runtime_schedule(rt, sp->caller);\n")
+	}
+
 	// gen.DumpRegisters(&b)
+	fmt.Fprintf(&b, "    %s", gen.Trace('e', "sp->cancelling"))
+	fmt.Fprintf(&b, "    %s", gen.Trace('E', "sp->cancelling"))
 	fmt.Fprintf(&b, "    free(sp);\n")
 	fmt.Fprintf(&b, "    return;\n")
 	return b.String()
@@ -229,6 +437,87 @@ func (g *genReturn) Deps() ([]register, []register) {
 	return g.ReturnValue, nil
 }
 
+// Guards keeps the state until every call that was started has returned,
+// since the call writes its results into the state.
+func (g *genReturn) Guards(gen *generator) []string {
+	if len(gen.ChildCalls) == 0 {
+		return nil
+	}
+	return []string{"sp->inflight_size == 0"}
+}
+
+// GuardDeps is empty, since the return is woken up when the last call in
+// flight returns.
+func (g *genReturn) GuardDeps() ([]register, []condition) {
+	return nil, nil
+}
+
+// genAfter delays a statement until values it consumes are no longer
+// borrowed, without otherwise changing what it does.
+type genAfter struct {
+	Statement generatedStatement
+	Waits     []borrowWait
+}
+
+// borrowWait is satisfied once Register is ready, or once any of the Skipped
+// conditions holds (because the borrower is then never going to run).
+type borrowWait struct {
+	Register register
+	Skipped  []condition
+}
+
+func (g *genAfter) Generate(gen *generator) string {
+	return g.Statement.Generate(gen)
+}
+
+func (g *genAfter) Deps() ([]register, []register) {
+	return g.Statement.Deps()
+}
+
+func (g *genAfter) Guards(gen *generator) []string {
+	guards := []string{}
+	if guarded, ok := g.Statement.(statementWithGuards); ok {
+		guards = append(guards, guarded.Guards(gen)...)
+	}
+	for _, wait := range g.Waits {
+		guard := gen.Ready(wait.Register)
+		for _, skipped := range wait.Skipped {
+			guard += fmt.Sprintf(" || sp->conditions[%d]", skipped)
+		}
+		if len(wait.Skipped) > 0 {
+			guard = "(" + guard + ")"
+		}
+		guards = append(guards, guard)
+	}
+	return guards
+}
+
+func (g *genAfter) GuardDeps() ([]register, []condition) {
+	registers := []register{}
+	conditions := []condition{}
+	if guarded, ok := g.Statement.(statementWithGuards); ok {
+		innerRegisters, innerConditions := guarded.GuardDeps()
+		registers = append(registers, innerRegisters...)
+		conditions = append(conditions, innerConditions...)
+	}
+	for _, wait := range g.Waits {
+		registers = append(registers, wait.Register)
+		conditions = append(conditions, wait.Skipped...)
+	}
+	return registers, conditions
+}
+
+func (g *genAfter) GenerateCancel(gen *generator, w io.Writer) {
+	if cancel, ok := g.Statement.(statementWithCancel); ok {
+		cancel.GenerateCancel(gen, w)
+		return
+	}
+	needs, _ := g.Statement.Deps()
+	for _, need := range needs {
+		gen.Cancel(need, "    ", w)
+	}
+}
+
 type genBranch struct {
 	Condition register
 	IfTrue    condition
@@ -249,24 +538,125 @@ func (g *genBranch) Deps() ([]register, []register) {
 	return []register{g.Condition}, nil
 }
 
-type genIntegerComparison struct {
+type genNumericComparison struct {
 	Operation string
 	Left      register
 	Right     register
 	Result    register
+	Kind      *Kind
+}
+
+func (g *genNumericComparison) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    %s.value = %s %s %s ? (void *)1 : (void *)0;\n", gen.Reg(g.Result), readNumber(gen.Reg(g.Left)+".value", g.Kind), g.Operation, readNumber(gen.Reg(g.Right)+".value", g.Kind))
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genNumericComparison) Deps() ([]register, []register) {
+	return []register{g.Left, g.Right}, []register{g.Result}
+}
+
+type genFloatLiteral struct {
+	Target register
+	Value  float64
+}
+
+func (g *genFloatLiteral) Generate(gen *generator) string {
+	return fmt.Sprintf("    %s = (future_t){.value = unique_effect_from_double(%s), .ready = true};\n", gen.Reg(g.Target), strconv.FormatFloat(g.Value, 'g', -1, 64))
 }
 
-func (g *genIntegerComparison) Generate(gen *generator) string {
+func (g *genFloatLiteral) Deps() ([]register, []register) {
+	return nil, []register{g.Target}
+}
+
+// genArithmetic applies a binary operator to two numbers. Integer overflow is
+// reported (with the position in the source) by unique_effect_overflow.
+type genArithmetic struct {
+	Op       string
+	Left     register
+	Right    register
+	Result   register
+	Kind     *Kind
+	Position string
+}
+
+func (g *genArithmetic) Generate(gen *generator) string {
 	b := strings.Builder{}
-	fmt.Fprintf(&b, "    %s.value = %s.value %s %s.value ? (void *)1 : (void *)0;\n", gen.Reg(g.Result), gen.Reg(g.Left), g.Operation, gen.Reg(g.Right))
+	ctype := numericType(g.Kind)
+	fmt.Fprintf(&b, "    %s lhs = %s, rhs = %s, result;\n", ctype, readNumber(gen.Reg(g.Left)+".value", g.Kind), readNumber(gen.Reg(g.Right)+".value", g.Kind))
+	if g.Kind.Family == FamilyFloat64 {
+		fmt.Fprintf(&b, "    result = lhs %s rhs;\n", g.Op)
+	} else if g.Op == "/" {
+		fmt.Fprintf(&b, "    if (rhs == 0) unique_effect_division_by_zero(%q);\n", g.Position)
+		if min := numericMin(g.Kind); min != "" {
+			fmt.Fprintf(&b, "    if (lhs == %s && rhs == -1) {\n", min)
+			fmt.Fprintf(&b, "      unique_effect_overflow(%q);\n", g.Position)
+			fmt.Fprintf(&b, "      result = lhs;\n")
+			fmt.Fprintf(&b, "    } else {\n")
+			fmt.Fprintf(&b, "      result = lhs / rhs;\n")
+			fmt.Fprintf(&b, "    }\n")
+		} else {
+			fmt.Fprintf(&b, "    result = lhs / rhs;\n")
+		}
+	} else {
+		builtin := map[string]string{"+": "add", "-": "sub", "*": "mul"}[g.Op]
+		fmt.Fprintf(&b, "    if (__builtin_%s_overflow(lhs, rhs, &result)) unique_effect_overflow(%q);\n", builtin, g.Position)
+	}
+	fmt.Fprintf(&b, "    %s.value = %s;\n", gen.Reg(g.Result), writeNumber("result", g.Kind))
 	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
 	return b.String()
 }
 
-func (g *genIntegerComparison) Deps() ([]register, []register) {
+func (g *genArithmetic) Deps() ([]register, []register) {
 	return []register{g.Left, g.Right}, []register{g.Result}
 }
 
+// numericType is the C type used to do arithmetic on the given kind.
+func numericType(kind *Kind) string {
+	switch {
+	case kind.Family == FamilyFloat64:
+		return "double"
+	case kind.Label == "Int32":
+		return "int32_t"
+	case kind.Label == "Int64":
+		return "int64_t"
+	case kind.Label == "UInt64":
+		return "uint64_t"
+	default:
+		return "intptr_t"
+	}
+}
+
+// numericMin is the smallest value of a signed integer kind, or "" if the kind
+// is unsigned.
+func numericMin(kind *Kind) string {
+	switch kind.Label {
+	case "Int32":
+		return "INT32_MIN"
+	case "Int64":
+		return "INT64_MIN"
+	case "UInt64":
+		return ""
+	default:
+		return "INTPTR_MIN"
+	}
+}
+
+func readNumber(expr string, kind *Kind) string {
+	if kind.Family == FamilyFloat64 {
+		return fmt.Sprintf("unique_effect_double(%s)", expr)
+	}
+	return fmt.Sprintf("(%s)(intptr_t)%s", numericType(kind), expr)
+}
+
+func writeNumber(expr string, kind *Kind) string {
+	if kind.Family == FamilyFloat64 {
+		return fmt.Sprintf("unique_effect_from_double(%s)", expr)
+	}
+	return fmt.Sprintf("(void *)(intptr_t)%s", expr)
+}
+
 type genNewArray struct {
 	Result register
 	Values []register
@@ -311,6 +701,8 @@ func (g *genMakeTuple) Deps() ([]register, []register) {
 type genUnpackTuple struct {
 	Input   register
 	Results []register
+	// Borrowed tuples are left intact, since they belong to someone else.
+	Borrowed bool
 }
 
 func (g *genUnpackTuple) Generate(gen *generator) string {
@@ -320,7 +712,9 @@ func (g *genUnpackTuple) Generate(gen *generator) string {
 		fmt.Fprintf(&b, "    %s.value = tuple[%d];\n", gen.Reg(result), i)
 		fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(result))
 	}
-	fmt.Fprintf(&b, "    free(%s.value);\n", gen.Reg(g.Input))
+	if !g.Borrowed {
+		fmt.Fprintf(&b, "    free(%s.value);\n", gen.Reg(g.Input))
+	}
 	return b.String()
 }
 
@@ -346,16 +740,130 @@ func (g *genCheckUnionType) Deps() ([]register, []register) {
 	return []register{g.Input}, []register{g.Result}
 }
 
-type genExtractUnionValue struct {
+type genMakeUnion struct {
+	Input     register
+	KindIndex int
+	Result    register
+}
+
+func (g *genMakeUnion) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    val_t* tagged = malloc(sizeof(val_t) * 2);\n")
+	fmt.Fprintf(&b, "    tagged[0] = (val_t)(intptr_t)%d;\n", g.KindIndex)
+	fmt.Fprintf(&b, "    tagged[1] = %s.value;\n", gen.Reg(g.Input))
+	fmt.Fprintf(&b, "    %s.value = tagged;\n", gen.Reg(g.Result))
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genMakeUnion) Deps() ([]register, []register) {
+	return []register{g.Input}, []register{g.Result}
+}
+
+type genMakeBox struct {
+	Input  register
+	Result register
+}
+
+func (g *genMakeBox) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    val_t* cell = malloc(sizeof(val_t));\n")
+	fmt.Fprintf(&b, "    cell[0] = %s.value;\n", gen.Reg(g.Input))
+	fmt.Fprintf(&b, "    %s.value = cell;\n", gen.Reg(g.Result))
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genMakeBox) Deps() ([]register, []register) {
+	return []register{g.Input}, []register{g.Result}
+}
+
+type genUnbox struct {
 	Input  register
 	Result register
 }
 
+func (g *genUnbox) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    %s.value = ((val_t*)%s.value)[0];\n", gen.Reg(g.Result), gen.Reg(g.Input))
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	fmt.Fprintf(&b, "    free(%s.value);\n", gen.Reg(g.Input))
+	return b.String()
+}
+
+func (g *genUnbox) Deps() ([]register, []register) {
+	return []register{g.Input}, []register{g.Result}
+}
+
+type genMakeShared struct {
+	Input  register
+	Result register
+}
+
+func (g *genMakeShared) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    struct unique_effect_shared *shared = malloc(sizeof(struct unique_effect_shared));\n")
+	fmt.Fprintf(&b, "    atomic_init(&shared->references, 1);\n")
+	fmt.Fprintf(&b, "    shared->value = %s.value;\n", gen.Reg(g.Input))
+	fmt.Fprintf(&b, "    %s.value = shared;\n", gen.Reg(g.Result))
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genMakeShared) Deps() ([]register, []register) {
+	return []register{g.Input}, []register{g.Result}
+}
+
+// genRetainShared makes another reference to a Shared value.
+type genRetainShared struct {
+	Input  register
+	Result register
+}
+
+func (g *genRetainShared) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    atomic_fetch_add(&((struct unique_effect_shared *)%s.value)->references, 1);\n", gen.Reg(g.Input))
+	fmt.Fprintf(&b, "    %s.value = %s.value;\n", gen.Reg(g.Result), gen.Reg(g.Input))
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genRetainShared) Deps() ([]register, []register) {
+	return []register{g.Input}, []register{g.Result}
+}
+
+// genSharedValue borrows the value inside a Shared.
+type genSharedValue struct {
+	Input  register
+	Result register
+}
+
+func (g *genSharedValue) Generate(gen *generator) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "    %s.value = ((struct unique_effect_shared *)%s.value)->value;\n", gen.Reg(g.Result), gen.Reg(g.Input))
+	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
+	return b.String()
+}
+
+func (g *genSharedValue) Deps() ([]register, []register) {
+	return []register{g.Input}, []register{g.Result}
+}
+
+// genExtractUnionValue unpacks the value inside a union. An owned union is
+// freed along the way, while a borrowed one is left to its owner.
+type genExtractUnionValue struct {
+	Input    register
+	Result   register
+	Borrowed bool
+}
+
 func (g *genExtractUnionValue) Generate(gen *generator) string {
 	b := strings.Builder{}
 	fmt.Fprintf(&b, "    %s.value = ((val_t*)%s.value)[1];\n", gen.Reg(g.Result), gen.Reg(g.Input))
 	fmt.Fprintf(&b, "    %s.ready = true;\n", gen.Reg(g.Result))
-	fmt.Fprintf(&b, "    free(%s.value);", gen.Reg(g.Input))
+	if !g.Borrowed {
+		fmt.Fprintf(&b, "    free(%s.value);", gen.Reg(g.Input))
+	}
 	return b.String()
 }
 
@@ -15,20 +15,32 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 
 	"github.com/fatlotus/unique_effect"
 )
 
+// Examples are read from, and compiled into, these directories.
+const (
+	sourceDir = "examples/"
+	outputDir = "gen/sources/"
+)
+
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Printf("Usage: %s [module name]\n", os.Args[0])
+	emitIR := flag.Bool("emit-ir", false, "also write the IR to gen/sources/[module name].ir")
+	stats := flag.Bool("stats", false, "print the size of each function's state")
+	criticalPath := flag.Bool("critical-path", false, "estimate how long the program takes, and print its critical path")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Printf("Usage: %s [-emit-ir] [-stats] [-critical-path] [module name]\n", os.Args[0])
 		os.Exit(1)
 	}
 
-	files, err := ioutil.ReadDir("examples/")
+	files, err := ioutil.ReadDir(sourceDir)
 	if err != nil {
 		fmt.Printf("Failed to read test dir: %v\n", err)
 		os.Exit(1)
@@ -37,7 +49,7 @@ func main() {
 
 	sources := map[string]string{}
 	for _, file := range files {
-		contents, err := ioutil.ReadFile("examples/" + file.Name())
+		contents, err := ioutil.ReadFile(sourceDir + file.Name())
 		if err != nil {
 			fmt.Printf("Failed to read file: %v\n", err)
 			os.Exit(1)
@@ -46,10 +58,26 @@ func main() {
 		sources[file.Name()] = string(contents)
 	}
 
-	result, err := unique_effect.Parse(os.Args[1], sources)
+	options := unique_effect.Options{
+		EmitIR:    *emitIR,
+		SourceDir: sourceDir,
+		OutputDir: outputDir,
+	}
+	if *stats {
+		options.Stats = os.Stderr
+	}
+	if *criticalPath {
+		options.CriticalPath = os.Stderr
+	}
+	result, err := unique_effect.Compile(flag.Arg(0), sources, options)
 	if err == nil {
-		for name, contents := range result {
-			err := ioutil.WriteFile(fmt.Sprintf("gen/sources/%s", name), []byte(contents), 0777)
+		names := []string{}
+		for name := range result {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			err := ioutil.WriteFile(outputDir+name, []byte(result[name]), 0777)
 			if err != nil {
 				fmt.Printf("failed to write file: %s\n", err)
 				os.Exit(1)